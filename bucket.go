@@ -1,166 +1,26 @@
 package luabolt
 
 import (
+	"strconv"
+	"strings"
+
 	"github.com/Shopify/go-lua"
 	"github.com/boltdb/bolt"
 )
 
 func init() {
-	registerMetaTable(TypeBucket, bucketFuncs)
+	registerMetaTable(TypeBucket, bucketFuncs, bucketMethods)
 }
 
 var bucketFuncs = []lua.RegistryFunction{
 	{
 		"__index", func(l *lua.State) int {
-			bucket := lua.CheckUserData(l, 1, TypeBucket).(*bolt.Bucket)
+			h := checkBucketHandle(l, 1)
 			switch k := lua.CheckString(l, 2); k {
+			case "codec":
+				l.PushString(h.codecName(l))
 			case "fill_percent":
-				l.PushNumber(bucket.FillPercent)
-			case "bucket":
-				l.PushGoFunction(func(l *lua.State) int {
-					name := checkBytes(l, 1)
-					b := bucket.Bucket(name)
-					if b == nil {
-						l.PushNil()
-					} else {
-						l.PushUserData(b)
-						lua.SetMetaTableNamed(l, TypeBucket)
-					}
-					return 1
-				})
-			case "create_bucket":
-				l.PushGoFunction(func(l *lua.State) int {
-					name := checkBytes(l, 1)
-					b, err := bucket.CreateBucket(name)
-					if err != nil {
-						lua.Errorf(l, err.Error())
-						panic("unreachable")
-					}
-					l.PushUserData(b)
-					lua.SetMetaTableNamed(l, TypeBucket)
-					return 1
-				})
-			case "create_bucket_if_not_exists":
-				l.PushGoFunction(func(l *lua.State) int {
-					name := checkBytes(l, 1)
-					b, err := bucket.CreateBucketIfNotExists(name)
-					if err != nil {
-						lua.Errorf(l, err.Error())
-						panic("unreachable")
-					}
-					l.PushUserData(b)
-					lua.SetMetaTableNamed(l, TypeBucket)
-					return 1
-				})
-			case "cursor":
-				l.PushGoFunction(func(l *lua.State) int {
-					c := bucket.Cursor()
-					l.PushUserData(c)
-					lua.SetMetaTableNamed(l, TypeCursor)
-					return 1
-				})
-			case "delete":
-				l.PushGoFunction(func(l *lua.State) int {
-					name := checkBytes(l, 1)
-					if err := bucket.Delete(name); err != nil {
-						lua.Errorf(l, err.Error())
-						panic("unreachable")
-					}
-					return 0
-				})
-			case "delete_bucket":
-				l.PushGoFunction(func(l *lua.State) int {
-					name := checkBytes(l, 1)
-					if err := bucket.DeleteBucket(name); err != nil {
-						lua.Errorf(l, err.Error())
-						panic("unreachable")
-					}
-					return 0
-				})
-			case "for_each":
-				l.PushGoFunction(func(l *lua.State) int {
-					lua.CheckType(l, 1, lua.TypeFunction)
-					err := bucket.ForEach(func(k, v []byte) error {
-						l.PushValue(1)
-						pushBytes(l, k)
-						pushBytes(l, v)
-						l.Call(2, 0)
-						return nil
-					})
-					if err != nil {
-						lua.Errorf(l, err.Error())
-						panic("unreachable")
-					}
-					return 0
-				})
-			case "get":
-				l.PushGoFunction(func(l *lua.State) int {
-					k := checkBytes(l, 1)
-					v := bucket.Get(k)
-					pushBytes(l, v)
-					return 1
-				})
-			case "next_sequence":
-				l.PushGoFunction(func(l *lua.State) int {
-					i, err := bucket.NextSequence()
-					if err != nil {
-						lua.Errorf(l, err.Error())
-						panic("unreachable")
-					}
-					l.PushUnsigned(uint(i))
-					return 1
-				})
-			case "put":
-				l.PushGoFunction(func(l *lua.State) int {
-					k := checkBytes(l, 1)
-					v := checkBytes(l, 2)
-					if err := bucket.Put(k, v); err != nil {
-						lua.Errorf(l, err.Error())
-						panic("unreachable")
-					}
-					return 0
-				})
-			case "root":
-				l.PushGoFunction(func(l *lua.State) int {
-					i := bucket.Root()
-					l.PushUnsigned(uint(i))
-					return 1
-				})
-			case "sequence":
-				l.PushGoFunction(func(l *lua.State) int {
-					i := bucket.Sequence()
-					l.PushUnsigned(uint(i))
-					return 1
-				})
-			case "set_sequence":
-				l.PushGoFunction(func(l *lua.State) int {
-					i := lua.CheckUnsigned(l, 1)
-					if err := bucket.SetSequence(uint64(i)); err != nil {
-						lua.Errorf(l, err.Error())
-						panic("unreachable")
-					}
-					return 0
-				})
-			case "stats":
-				l.PushGoFunction(func(l *lua.State) int {
-					stats := bucket.Stats()
-					l.PushUserData(&stats)
-					lua.SetMetaTableNamed(l, TypeBucketStats)
-					return 1
-				})
-			case "tx":
-				l.PushGoFunction(func(l *lua.State) int {
-					tx := bucket.Tx()
-					l.PushUserData(&tx)
-					lua.SetMetaTableNamed(l, TypeTx)
-					return 1
-				})
-			case "writable":
-				l.PushGoFunction(func(l *lua.State) int {
-					b := bucket.Writable()
-					l.PushBoolean(b)
-					return 1
-				})
+				l.PushNumber(h.bucket.FillPercent)
 			default:
 				lua.Errorf(l, "bolt: unknown Bucket.%s", k)
 				panic("unreachable")
@@ -168,12 +28,27 @@ var bucketFuncs = []lua.RegistryFunction{
 			return 1
 		},
 	},
+	{
+		"__pairs", func(l *lua.State) int {
+			bucket, h := checkBucket(l, 1)
+			pushScan(l, bucket.Cursor(), h, false, nil, nil, nil)
+			return 1
+		},
+	},
 	{
 		"__newindex", func(l *lua.State) int {
-			bucket := lua.CheckUserData(l, 1, TypeBucket).(*bolt.Bucket)
+			h := checkBucketHandle(l, 1)
 			switch k := lua.CheckString(l, 2); k {
+			case "codec":
+				if l.IsNil(3) {
+					h.setCodec(l, "")
+				} else {
+					checkCodec(l, 3, "")
+					name, _ := l.ToString(3)
+					h.setCodec(l, name)
+				}
 			case "fill_percent":
-				bucket.FillPercent = lua.CheckNumber(l, 3)
+				h.bucket.FillPercent = lua.CheckNumber(l, 3)
 			default:
 				lua.Errorf(l, "bolt: unknown Bucket.%s", k)
 				panic("unreachable")
@@ -182,3 +57,430 @@ var bucketFuncs = []lua.RegistryFunction{
 		},
 	},
 }
+
+var bucketMethods = []lua.RegistryFunction{
+	{
+		"bucket", func(l *lua.State) int {
+			h := checkBucketHandle(l, 1)
+			name := checkBytes(l, 2)
+			b := h.bucket.Bucket(name)
+			if b == nil {
+				l.PushNil()
+			} else {
+				h.pushChild(l, b, name)
+			}
+			return 1
+		},
+	},
+	{
+		"create_bucket", func(l *lua.State) int {
+			h := checkBucketHandle(l, 1)
+			name := checkBytes(l, 2)
+			b, err := h.bucket.CreateBucket(name)
+			if err != nil {
+				return fail(l, "Bucket.create_bucket", err)
+			}
+			h.pushChild(l, b, name)
+			return 1
+		},
+	},
+	{
+		"create_bucket_if_not_exists", func(l *lua.State) int {
+			h := checkBucketHandle(l, 1)
+			name := checkBytes(l, 2)
+			b, err := h.bucket.CreateBucketIfNotExists(name)
+			if err != nil {
+				return fail(l, "Bucket.create_bucket_if_not_exists", err)
+			}
+			h.pushChild(l, b, name)
+			return 1
+		},
+	},
+	{
+		"cursor", func(l *lua.State) int {
+			h := checkBucketHandle(l, 1)
+			pushCursor(l, h.bucket.Cursor(), h.tx, h.path)
+			return 1
+		},
+	},
+	{
+		"delete", func(l *lua.State) int {
+			bucket, _ := checkBucket(l, 1)
+			name := checkBytes(l, 2)
+			if err := bucket.Delete(name); err != nil {
+				return fail(l, "Bucket.delete", err)
+			}
+			l.PushBoolean(true)
+			return 1
+		},
+	},
+	{
+		"delete_bucket", func(l *lua.State) int {
+			h := checkBucketHandle(l, 1)
+			name := checkBytes(l, 2)
+			if err := h.bucket.DeleteBucket(name); err != nil {
+				return fail(l, "Bucket.delete_bucket", err)
+			}
+			if h.path != nil {
+				h.tx.deleteBucketCodecs(l, append(h.path[:len(h.path):len(h.path)], string(name)))
+			}
+			l.PushBoolean(true)
+			return 1
+		},
+	},
+	{
+		"for_each", func(l *lua.State) int {
+			bucket, _ := checkBucket(l, 1)
+			lua.CheckType(l, 2, lua.TypeFunction)
+			f := newIterCallback(l, "Bucket.for_each", 2)
+			return f.result(bucket.ForEach(func(k, v []byte) error {
+				pushBytes(l, k)
+				pushBytes(l, v)
+				return f.call(2)
+			}))
+		},
+	},
+	{
+		"get", func(l *lua.State) int {
+			bucket, _ := checkBucket(l, 1)
+			k := checkBytes(l, 2)
+			v := bucket.Get(k)
+			pushBytes(l, v)
+			return 1
+		},
+	},
+	{
+		"get_value", func(l *lua.State) int {
+			h := checkBucketHandle(l, 1)
+			k := checkBytes(l, 2)
+			c := checkCodec(l, 3, h.codecName(l))
+			data := h.bucket.Get(k)
+			if data == nil {
+				l.PushNil()
+				return 1
+			}
+			v, err := c.Decode(data)
+			if err == nil {
+				err = pushValue(l, v)
+			}
+			if err != nil {
+				return fail(l, "Bucket.get_value", err)
+			}
+			return 1
+		},
+	},
+	{
+		"next_sequence", func(l *lua.State) int {
+			bucket, _ := checkBucket(l, 1)
+			i, err := bucket.NextSequence()
+			if err != nil {
+				return fail(l, "Bucket.next_sequence", err)
+			}
+			l.PushUnsigned(uint(i))
+			return 1
+		},
+	},
+	{
+		"pairs", func(l *lua.State) int {
+			bucket, h := checkBucket(l, 1)
+			pushScan(l, bucket.Cursor(), h, false, nil, nil, nil)
+			return 1
+		},
+	},
+	{
+		"pairs_reverse", func(l *lua.State) int {
+			bucket, h := checkBucket(l, 1)
+			pushScan(l, bucket.Cursor(), h, true, nil, nil, nil)
+			return 1
+		},
+	},
+	{
+		"prefix", func(l *lua.State) int {
+			bucket, h := checkBucket(l, 1)
+			prefix := checkBytes(l, 2)
+			pushScan(l, bucket.Cursor(), h, false, prefix, nil, nil)
+			return 1
+		},
+	},
+	{
+		"prefix_reverse", func(l *lua.State) int {
+			bucket, h := checkBucket(l, 1)
+			prefix := checkBytes(l, 2)
+			pushScan(l, bucket.Cursor(), h, true, prefix, nil, nil)
+			return 1
+		},
+	},
+	{
+		"put", func(l *lua.State) int {
+			bucket, _ := checkBucket(l, 1)
+			k := checkBytes(l, 2)
+			v := checkBytes(l, 3)
+			if err := bucket.Put(k, v); err != nil {
+				return fail(l, "Bucket.put", err)
+			}
+			l.PushBoolean(true)
+			return 1
+		},
+	},
+	{
+		"put_value", func(l *lua.State) int {
+			h := checkBucketHandle(l, 1)
+			k := checkBytes(l, 2)
+			lua.CheckAny(l, 3)
+			c := checkCodec(l, 4, h.codecName(l))
+			v, err := DefaultConversion.toValue(l, 3)
+			if err != nil {
+				return fail(l, "Bucket.put_value", err)
+			}
+			data, err := c.Encode(v)
+			if err != nil {
+				return fail(l, "Bucket.put_value", err)
+			}
+			if err := h.bucket.Put(k, data); err != nil {
+				return fail(l, "Bucket.put_value", err)
+			}
+			l.PushBoolean(true)
+			return 1
+		},
+	},
+	{
+		"range", func(l *lua.State) int {
+			bucket, h := checkBucket(l, 1)
+			from, to := checkRange(l, 2)
+			pushScan(l, bucket.Cursor(), h, false, nil, from, to)
+			return 1
+		},
+	},
+	{
+		"range_reverse", func(l *lua.State) int {
+			bucket, h := checkBucket(l, 1)
+			from, to := checkRange(l, 2)
+			pushScan(l, bucket.Cursor(), h, true, nil, from, to)
+			return 1
+		},
+	},
+	{
+		"root", func(l *lua.State) int {
+			bucket, _ := checkBucket(l, 1)
+			i := bucket.Root()
+			l.PushUnsigned(uint(i))
+			return 1
+		},
+	},
+	{
+		"sequence", func(l *lua.State) int {
+			bucket, _ := checkBucket(l, 1)
+			i := bucket.Sequence()
+			l.PushUnsigned(uint(i))
+			return 1
+		},
+	},
+	{
+		"set_sequence", func(l *lua.State) int {
+			bucket, _ := checkBucket(l, 1)
+			i := lua.CheckUnsigned(l, 2)
+			if err := bucket.SetSequence(uint64(i)); err != nil {
+				return fail(l, "Bucket.set_sequence", err)
+			}
+			l.PushBoolean(true)
+			return 1
+		},
+	},
+	{
+		"stats", func(l *lua.State) int {
+			bucket, _ := checkBucket(l, 1)
+			stats := bucket.Stats()
+			l.PushUserData(&stats)
+			lua.SetMetaTableNamed(l, TypeBucketStats)
+			return 1
+		},
+	},
+	{
+		"tx", func(l *lua.State) int {
+			_, h := checkBucket(l, 1)
+			pushTx(l, h)
+			return 1
+		},
+	},
+	{
+		"writable", func(l *lua.State) int {
+			bucket, _ := checkBucket(l, 1)
+			b := bucket.Writable()
+			l.PushBoolean(b)
+			return 1
+		},
+	},
+}
+
+// bucketHandle is the value of a Bucket userdata.
+type bucketHandle struct {
+	bucket *bolt.Bucket
+	tx     *txHandle
+	// path is the names of the bucket and of its parents, which identify
+	// its codec in the codecs of the state. It is nil for the buckets
+	// pushed by the host, whose names aren't known.
+	path []string
+	// codec is the name of the codec of put_value and get_value, if set,
+	// for the buckets without a path.
+	codec string
+}
+
+// bucketKey returns the key of the bucket at path in the codecs of the
+// state.
+func bucketKey(path []string) string {
+	var b strings.Builder
+	for _, name := range path {
+		b.WriteString(strconv.Itoa(len(name)))
+		b.WriteByte(':')
+		b.WriteString(name)
+	}
+	return b.String()
+}
+
+// codecName returns the name of the codec of the bucket: the codec set on
+// it, or else on its closest parent, or else DefaultCodec.
+func (h *bucketHandle) codecName(l *lua.State) string {
+	if h.path == nil {
+		if h.codec == "" {
+			return DefaultCodec
+		}
+		return h.codec
+	}
+	codecs := stateResources(l).codecs[h.bucket.Tx().DB()]
+	for n := len(h.path); n >= 0; n-- {
+		if name := h.tx.bucketCodec(codecs, bucketKey(h.path[:n])); name != "" {
+			return name
+		}
+	}
+	return DefaultCodec
+}
+
+// setCodec sets the codec of the bucket to the codec called name, or
+// unsets it if name is empty. It raises an error if the transaction isn't
+// writable.
+func (h *bucketHandle) setCodec(l *lua.State, name string) {
+	if h.tx.readOnly {
+		raise(l, "Bucket.codec", ErrPermission)
+	}
+	if !h.bucket.Writable() {
+		raise(l, "Bucket.codec", bolt.ErrTxNotWritable)
+	}
+	if h.path == nil {
+		h.codec = name
+		return
+	}
+	h.tx.addCodecOp(l, codecOp{key: bucketKey(h.path), name: name})
+}
+
+// codecOp is a change of the codecs of the buckets in a transaction, which
+// the state keeps once the transaction is committed.
+type codecOp struct {
+	key string
+	// name is the codec set on the bucket at key, or empty to unset it.
+	name string
+	// tree unsets the codecs of the children of the bucket too, once it
+	// is deleted.
+	tree bool
+}
+
+// bucketCodec returns the name of the codec set on the bucket at key in
+// the transaction, or else in codecs, the codecs of the state for its
+// database.
+func (s *txState) bucketCodec(codecs map[string]string, key string) string {
+	for i := len(s.codecOps) - 1; i >= 0; i-- {
+		op := s.codecOps[i]
+		if op.key == key || op.tree && strings.HasPrefix(key, op.key) {
+			return op.name
+		}
+	}
+	return codecs[key]
+}
+
+// addCodecOp adds op to the changes of the codecs in the transaction.
+func (s *txState) addCodecOp(l *lua.State, op codecOp) {
+	if len(s.codecOps) == 0 {
+		r, db := stateResources(l), s.tx.DB()
+		s.tx.OnCommit(func() { r.applyCodecOps(db, s.codecOps) })
+	}
+	s.codecOps = append(s.codecOps, op)
+}
+
+// deleteBucketCodecs unsets the codecs of the bucket at path and of its
+// children, deleted in the transaction.
+func (s *txState) deleteBucketCodecs(l *lua.State, path []string) {
+	s.addCodecOp(l, codecOp{key: bucketKey(path), tree: true})
+}
+
+// applyCodecOps applies ops, the changes of the codecs of a transaction
+// committed on db.
+func (r *resources) applyCodecOps(db *bolt.DB, ops []codecOp) {
+	codecs := r.codecs[db]
+	for _, op := range ops {
+		switch {
+		case op.tree:
+			for key := range codecs {
+				if strings.HasPrefix(key, op.key) {
+					delete(codecs, key)
+				}
+			}
+		case op.name == "":
+			delete(codecs, op.key)
+		default:
+			if codecs == nil {
+				codecs = make(map[string]string)
+				if r.codecs == nil {
+					r.codecs = make(map[*bolt.DB]map[string]string)
+				}
+				r.codecs[db] = codecs
+			}
+			codecs[op.key] = op.name
+		}
+	}
+	if len(codecs) == 0 {
+		delete(r.codecs, db)
+	}
+}
+
+// pushChild pushes b, the bucket called name in the bucket of h. A bucket
+// without a path inherits the codec of h.
+func (h *bucketHandle) pushChild(l *lua.State, b *bolt.Bucket, name []byte) {
+	child := &bucketHandle{bucket: b, tx: h.tx, codec: h.codec}
+	if h.path != nil {
+		child.path = append(h.path[:len(h.path):len(h.path)], string(name))
+	}
+	l.PushUserData(child)
+	lua.SetMetaTableNamed(l, TypeBucket)
+}
+
+// pushBucket pushes b, whose names from the root bucket are path, or nil
+// if they aren't known.
+func pushBucket(l *lua.State, b *bolt.Bucket, tx *txHandle, path []string) {
+	l.PushUserData(&bucketHandle{bucket: b, tx: tx, path: path})
+	lua.SetMetaTableNamed(l, TypeBucket)
+}
+
+// checkBucket returns the bucket at index, and the transaction it belongs
+// to. It raises an error if the transaction is closed.
+func checkBucket(l *lua.State, index int) (*bolt.Bucket, *txHandle) {
+	h := checkBucketHandle(l, index)
+	return h.bucket, h.tx
+}
+
+// checkBucketHandle is like checkBucket, but returns the handle of the
+// bucket.
+func checkBucketHandle(l *lua.State, index int) *bucketHandle {
+	h := lua.CheckUserData(l, index, TypeBucket).(*bucketHandle)
+	h.tx.check(l, "Bucket")
+	return h
+}
+
+// checkRange returns the optional bounds of a range, at index and index+1.
+func checkRange(l *lua.State, index int) (from, to []byte) {
+	if !l.IsNoneOrNil(index) {
+		from = checkBytes(l, index)
+	}
+	if !l.IsNoneOrNil(index + 1) {
+		to = checkBytes(l, index+1)
+	}
+	return from, to
+}
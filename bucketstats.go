@@ -6,7 +6,7 @@ import (
 )
 
 func init() {
-	registerMetaTable(TypeBucketStats, bucketStatsFuncs)
+	registerMetaTable(TypeBucketStats, bucketStatsFuncs, bucketStatsMethods)
 }
 
 var bucketStatsFuncs = []lua.RegistryFunction{
@@ -40,12 +40,6 @@ var bucketStatsFuncs = []lua.RegistryFunction{
 				l.PushInteger(bucketStats.InlineBucketN)
 			case "inline_bucket_inuse":
 				l.PushInteger(bucketStats.InlineBucketInuse)
-			case "add":
-				l.PushGoFunction(func(l *lua.State) int {
-					other := lua.CheckUserData(l, 1, TypeBucketStats).(*bolt.BucketStats)
-					bucketStats.Add(*other)
-					return 0
-				})
 			default:
 				lua.Errorf(l, "bolt: unknown BucketStats.%s", k)
 				panic("unreachable")
@@ -91,3 +85,18 @@ var bucketStatsFuncs = []lua.RegistryFunction{
 		},
 	},
 }
+
+var bucketStatsMethods = []lua.RegistryFunction{
+	{
+		"add", func(l *lua.State) int {
+			bucketStats := checkBucketStats(l, 1)
+			other := checkBucketStats(l, 2)
+			bucketStats.Add(*other)
+			return 0
+		},
+	},
+}
+
+func checkBucketStats(l *lua.State, index int) *bolt.BucketStats {
+	return lua.CheckUserData(l, index, TypeBucketStats).(*bolt.BucketStats)
+}
@@ -0,0 +1,123 @@
+package luabolt
+
+import (
+	"errors"
+
+	"github.com/Shopify/go-lua"
+	"github.com/boltdb/bolt"
+)
+
+// errStop is returned to bolt to end an iteration early. Lua sees it as
+// bolt.STOP.
+var errStop = errors.New("bolt: stop")
+
+// callback calls a Lua function given to a method, so that the errors it
+// raises don't escape through bolt.
+//
+// The Lua function fails either by raising an error, by returning nil (or
+// false) followed by an error, or by returning a bolt.Error. An iteration
+// callback also ends the iteration by returning false or bolt.STOP.
+type callback struct {
+	l        *lua.State
+	op       string
+	index    int
+	top      int
+	iterator bool
+	raised   bool
+	returned error
+	failed   error
+	// readOnly is set when the transaction is run from a read-only DB.
+	readOnly bool
+}
+
+// newTxCallback returns a callback for the Lua function at index, to run
+// in a transaction.
+func newTxCallback(l *lua.State, op string, index int) *callback {
+	return &callback{l: l, op: op, index: index, top: l.Top()}
+}
+
+// newIterCallback returns a callback for the Lua function at index, to be
+// called for each item of an iteration.
+func newIterCallback(l *lua.State, op string, index int) *callback {
+	return &callback{l: l, op: op, index: index, top: l.Top(), iterator: true}
+}
+
+// callTx calls the callback with tx, and returns its error so that bolt
+// rolls back the transaction on failure. The transaction is closed for
+// the script when the callback returns.
+func (f *callback) callTx(tx *bolt.Tx) error {
+	h := &txHandle{&txState{tx: tx, managed: true, readOnly: f.readOnly}}
+	trackTx(f.l, h.txState)
+	defer h.close()
+	f.l.SetTop(f.top)
+	pushTx(f.l, h)
+	return f.call(1)
+}
+
+// callBatch is callTx for DB.batch.
+//
+// Bolt may call it from another goroutine, while the goroutine of the
+// state waits for DB.batch to return, and calls it again when a function
+// of the same batch failed, since its writes were rolled back. But once
+// the callback failed itself, it isn't called again: bolt only runs it
+// alone to find out which function of the batch failed.
+func (f *callback) callBatch(tx *bolt.Tx) error {
+	if f.failed != nil {
+		return f.failed
+	}
+	err := f.callTx(tx)
+	f.failed = err
+	return err
+}
+
+// call calls the callback with the nargs values on top of the stack. When
+// the callback raises an error, its value is left on the stack for result
+// to raise it again.
+func (f *callback) call(nargs int) error {
+	l := f.l
+	f.raised, f.returned = false, nil
+	l.PushValue(f.index)
+	l.Insert(-nargs - 1)
+	if err := l.ProtectedCall(nargs, 2, 0); err != nil {
+		f.raised = true
+		return err
+	}
+	defer l.SetTop(f.top)
+	switch {
+	case lua.TestUserData(l, -2, TypeError) != nil:
+		f.returned = toError(l, -2)
+	case !l.ToBoolean(-2) && !l.IsNil(-1):
+		f.returned = toError(l, -1)
+	case f.iterator && (l.ToUserData(-2) == errStop || (l.IsBoolean(-2) && !l.ToBoolean(-2))):
+		return errStop
+	}
+	return f.returned
+}
+
+// result pushes the outcome of the method, given the error returned by
+// bolt: true on success. A transaction method returns nil and the error
+// returned by the callback, while other errors are raised, or returned
+// like the former in safe mode.
+func (f *callback) result(err error) int {
+	l := f.l
+	switch {
+	case err == nil, err == errStop:
+		l.PushBoolean(true)
+		return 1
+	case f.raised && isSafe(l):
+		l.PushNil()
+		l.Insert(-2)
+		return 2
+	case f.raised:
+		rethrow(l, err)
+	case err == f.returned && !f.iterator:
+		l.PushNil()
+		if e, ok := err.(*Error); ok {
+			pushError(l, e)
+		} else {
+			l.PushString(err.Error())
+		}
+		return 2
+	}
+	return fail(l, f.op, err)
+}
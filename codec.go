@@ -0,0 +1,136 @@
+package luabolt
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/Shopify/go-lua"
+)
+
+// Codec encodes the Lua values stored by Bucket.put_value, and decodes
+// those returned by Bucket.get_value.
+//
+// Encode is given the Go value of a Lua value, as converted by
+// DefaultConversion. Decode returns a value of the same kinds: nil, bool,
+// numbers, string, []byte, slices and maps, converted to a Lua value like
+// the arguments of Exec.
+//
+// The codec field of a bucket sets the default codec of the bucket and of
+// its children, for the scripts of its Lua state only. It is set in a
+// write transaction, and kept once the transaction is committed.
+type Codec interface {
+	Encode(v interface{}) ([]byte, error)
+	Decode(data []byte) (interface{}, error)
+}
+
+// DefaultCodec is the name of the codec of the buckets whose codec field
+// isn't set.
+const DefaultCodec = "json"
+
+var codecs = map[string]Codec{
+	"json":    jsonCodec{},
+	"msgpack": msgpackCodec{},
+}
+
+// RegisterCodec adds the codec name, or replaces the codec of that name.
+// The json and msgpack codecs are built in.
+//
+// Like RegisterMethod, RegisterCodec must be called before the bolt module
+// is opened in a Lua state, usually from an init function.
+func RegisterCodec(name string, c Codec) {
+	codecs[name] = c
+}
+
+// checkCodec returns the codec whose name is at index, or the codec named
+// def if the value at index is nil or none.
+func checkCodec(l *lua.State, index int, def string) Codec {
+	name := lua.OptString(l, index, def)
+	c, ok := codecs[name]
+	if !ok {
+		lua.Errorf(l, "bolt: unknown codec %s", name)
+		panic("unreachable")
+	}
+	return c
+}
+
+// bytesKey is the key of the JSON objects holding a binary string, base64
+// encoded.
+const bytesKey = "$bytes"
+
+// jsonCodec encodes values as JSON.
+//
+// Tables must be sequences or only have string keys. Strings which aren't
+// valid UTF-8 are encoded as an object with a single "$bytes" key, and such
+// objects are decoded as strings.
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(v interface{}) ([]byte, error) {
+	v, err := toJSON(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Decode(data []byte) (interface{}, error) {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return fromJSON(v), nil
+}
+
+// toJSON returns v, with its binary strings replaced by objects.
+func toJSON(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case []byte:
+		if utf8.Valid(v) {
+			return string(v), nil
+		}
+		return map[string]interface{}{bytesKey: base64.StdEncoding.EncodeToString(v)}, nil
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, e := range v {
+			var err error
+			if s[i], err = toJSON(e); err != nil {
+				return nil, err
+			}
+		}
+		return s, nil
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			var err error
+			if m[k], err = toJSON(e); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case map[interface{}]interface{}:
+		return nil, fmt.Errorf("luabolt: can't encode a table with non-string keys as JSON")
+	}
+	return v, nil
+}
+
+// fromJSON returns v, with the objects holding binary strings replaced by
+// them.
+func fromJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []interface{}:
+		for i, e := range v {
+			v[i] = fromJSON(e)
+		}
+	case map[string]interface{}:
+		if s, ok := v[bytesKey].(string); ok && len(v) == 1 {
+			if b, err := base64.StdEncoding.DecodeString(s); err == nil {
+				return b
+			}
+		}
+		for k, e := range v {
+			v[k] = fromJSON(e)
+		}
+	}
+	return v
+}
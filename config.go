@@ -0,0 +1,99 @@
+package luabolt
+
+import (
+	"errors"
+	"os"
+	"reflect"
+
+	"github.com/Shopify/go-lua"
+	"github.com/boltdb/bolt"
+)
+
+// ErrPermission is returned when a script uses a capability of the bolt
+// module which isn't exposed to it.
+var ErrPermission = errors.New("permission denied")
+
+// Capability is a set of features of the bolt module which can be denied
+// to the scripts.
+type Capability uint
+
+const (
+	CapOpen     Capability = 1 << iota // bolt.open
+	CapWrite                           // DB.update, DB.batch and DB.begin(true)
+	CapPageInfo                        // Tx.page_info
+	CapCheck                           // Tx.check
+	CapCopyFile                        // Tx.copy_file
+)
+
+// Config configures the bolt module opened by OpenWith.
+type Config struct {
+	// Name is the name of the module, "bolt" if empty.
+	Name string
+	// Global sets the module as a global variable of the same name.
+	Global bool
+	// Safe makes the methods return nil and a bolt.Error on failure,
+	// instead of raising errors, like OpenSafe.
+	Safe bool
+	// Disabled are the capabilities denied to the scripts, which get an
+	// ERR_PERMISSION error when using them.
+	Disabled Capability
+	// Options are the default options of bolt.open and bolt.options. The
+	// options given as a table start from them.
+	Options *bolt.Options
+
+	// Root, if set, is the directory the paths of bolt.open and
+	// Tx.copy_file are relative to. The paths which are absolute, have a
+	// .. element, or lead outside of Root through symbolic links get an
+	// ERR_PERMISSION error.
+	Root string
+	// Modes, if set, are the file modes bolt.open and Tx.copy_file accept.
+	Modes []os.FileMode
+	// MaxOpen, if set, is the number of databases a state may have open at
+	// once with bolt.open.
+	MaxOpen int
+}
+
+// configKey is the registry field holding the Config of the module.
+const configKey = "github.com/vincent-petithory/luabolt.config"
+
+func stateConfig(l *lua.State) *Config {
+	if config, ok := openConfig(l); ok {
+		return config
+	}
+	return &Config{}
+}
+
+// openConfig returns the Config of the bolt module, and whether it is
+// open in the state.
+func openConfig(l *lua.State) (*Config, bool) {
+	l.Field(lua.RegistryIndex, configKey)
+	config, ok := l.ToUserData(-1).(*Config)
+	l.Pop(1)
+	return config, ok
+}
+
+// sameConfig reports whether a and b configure the bolt module the same
+// way, whatever the name and global variable of the module.
+func sameConfig(a, b Config) bool {
+	a.Name, a.Global = "", false
+	b.Name, b.Global = "", false
+	return reflect.DeepEqual(a, b)
+}
+
+func isSafe(l *lua.State) bool {
+	return stateConfig(l).Safe
+}
+
+// allowed reports whether the scripts of the state have the capability c.
+func allowed(l *lua.State, c Capability) bool {
+	return stateConfig(l).Disabled&c == 0
+}
+
+// defaultOptions returns a copy of the default options of the state.
+func defaultOptions(l *lua.State) *bolt.Options {
+	options := &bolt.Options{}
+	if o := stateConfig(l).Options; o != nil {
+		*options = *o
+	}
+	return options
+}
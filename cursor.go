@@ -1,75 +1,23 @@
 package luabolt
 
 import (
+	"bytes"
+
 	"github.com/Shopify/go-lua"
 	"github.com/boltdb/bolt"
 )
 
 func init() {
-	registerMetaTable(TypeCursor, cursorFuncs)
+	registerMetaTable(TypeCursor, cursorFuncs, cursorMethods)
 }
 
 var cursorFuncs = []lua.RegistryFunction{
 	{
 		"__index", func(l *lua.State) int {
-			cursor := lua.CheckUserData(l, 1, TypeCursor).(*bolt.Cursor)
-			switch k := lua.CheckString(l, 2); k {
-			case "bucket":
-				l.PushGoFunction(func(l *lua.State) int {
-					b := cursor.Bucket()
-					l.PushUserData(b)
-					lua.SetMetaTableNamed(l, TypeBucket)
-					return 1
-				})
-			case "delete":
-				l.PushGoFunction(func(l *lua.State) int {
-					if err := cursor.Delete(); err != nil {
-						lua.Errorf(l, err.Error())
-						panic("unreachable")
-					}
-					return 0
-				})
-			case "first":
-				l.PushGoFunction(func(l *lua.State) int {
-					k, v := cursor.First()
-					pushBytes(l, k)
-					pushBytes(l, v)
-					return 2
-				})
-			case "last":
-				l.PushGoFunction(func(l *lua.State) int {
-					k, v := cursor.Last()
-					pushBytes(l, k)
-					pushBytes(l, v)
-					return 2
-				})
-			case "next":
-				l.PushGoFunction(func(l *lua.State) int {
-					k, v := cursor.Next()
-					pushBytes(l, k)
-					pushBytes(l, v)
-					return 2
-				})
-			case "prev":
-				l.PushGoFunction(func(l *lua.State) int {
-					k, v := cursor.Prev()
-					pushBytes(l, k)
-					pushBytes(l, v)
-					return 2
-				})
-			case "seek":
-				l.PushGoFunction(func(l *lua.State) int {
-					seek := checkBytes(l, 1)
-					k, v := cursor.Seek(seek)
-					pushBytes(l, k)
-					pushBytes(l, v)
-					return 2
-				})
-			default:
-				lua.Errorf(l, "bolt: unknown Cursor.%s", k)
-				panic("unreachable")
-			}
-			return 1
+			lua.CheckUserData(l, 1, TypeCursor)
+			k := lua.CheckString(l, 2)
+			lua.Errorf(l, "bolt: unknown Cursor.%s", k)
+			panic("unreachable")
 		},
 	},
 	{
@@ -78,3 +26,177 @@ var cursorFuncs = []lua.RegistryFunction{
 		},
 	},
 }
+
+var cursorMethods = []lua.RegistryFunction{
+	{
+		"bucket", func(l *lua.State) int {
+			h := checkCursorHandle(l, 1)
+			pushBucket(l, h.cursor.Bucket(), h.tx, h.path)
+			return 1
+		},
+	},
+	{
+		"delete", func(l *lua.State) int {
+			cursor, _ := checkCursor(l, 1)
+			if err := cursor.Delete(); err != nil {
+				return fail(l, "Cursor.delete", err)
+			}
+			l.PushBoolean(true)
+			return 1
+		},
+	},
+	{
+		"first", func(l *lua.State) int {
+			cursor, _ := checkCursor(l, 1)
+			k, v := cursor.First()
+			pushBytes(l, k)
+			pushBytes(l, v)
+			return 2
+		},
+	},
+	{
+		"last", func(l *lua.State) int {
+			cursor, _ := checkCursor(l, 1)
+			k, v := cursor.Last()
+			pushBytes(l, k)
+			pushBytes(l, v)
+			return 2
+		},
+	},
+	{
+		"next", func(l *lua.State) int {
+			cursor, _ := checkCursor(l, 1)
+			k, v := cursor.Next()
+			pushBytes(l, k)
+			pushBytes(l, v)
+			return 2
+		},
+	},
+	{
+		"prev", func(l *lua.State) int {
+			cursor, _ := checkCursor(l, 1)
+			k, v := cursor.Prev()
+			pushBytes(l, k)
+			pushBytes(l, v)
+			return 2
+		},
+	},
+	{
+		"seek", func(l *lua.State) int {
+			cursor, _ := checkCursor(l, 1)
+			seek := checkBytes(l, 2)
+			k, v := cursor.Seek(seek)
+			pushBytes(l, k)
+			pushBytes(l, v)
+			return 2
+		},
+	},
+}
+
+// cursorHandle is the value of a Cursor userdata.
+type cursorHandle struct {
+	cursor *bolt.Cursor
+	tx     *txHandle
+	// path is the path of the bucket of the cursor, like bucketHandle.path.
+	path []string
+}
+
+func pushCursor(l *lua.State, c *bolt.Cursor, tx *txHandle, path []string) {
+	l.PushUserData(&cursorHandle{cursor: c, tx: tx, path: path})
+	lua.SetMetaTableNamed(l, TypeCursor)
+}
+
+// checkCursor returns the cursor at index, and the transaction it belongs
+// to. It raises an error if the transaction is closed.
+func checkCursor(l *lua.State, index int) (*bolt.Cursor, *txHandle) {
+	h := checkCursorHandle(l, index)
+	return h.cursor, h.tx
+}
+
+// checkCursorHandle is like checkCursor, but returns the handle of the
+// cursor.
+func checkCursorHandle(l *lua.State, index int) *cursorHandle {
+	h := lua.CheckUserData(l, index, TypeCursor).(*cursorHandle)
+	h.tx.check(l, "Cursor")
+	return h
+}
+
+// pushScan pushes a generic-for iterator function walking the cursor c of
+// the transaction tx, in reverse order if reverse is set. The walk is
+// limited to the keys starting with prefix, and to the keys between from
+// and to (inclusive); a nil bound doesn't limit it.
+func pushScan(l *lua.State, c *bolt.Cursor, tx *txHandle, reverse bool, prefix, from, to []byte) {
+	started := false
+	l.PushGoFunction(func(l *lua.State) int {
+		tx.check(l, "Cursor")
+		var k, v []byte
+		switch {
+		case !started && reverse:
+			k, v = seekLast(c, prefix, to)
+		case !started:
+			k, v = seekFirst(c, prefix, from)
+		case reverse:
+			k, v = c.Prev()
+		default:
+			k, v = c.Next()
+		}
+		started = true
+		if k == nil ||
+			!bytes.HasPrefix(k, prefix) ||
+			(from != nil && bytes.Compare(k, from) < 0) ||
+			(to != nil && bytes.Compare(k, to) > 0) {
+			l.PushNil()
+			return 1
+		}
+		pushBytes(l, k)
+		pushBytes(l, v)
+		return 2
+	})
+}
+
+// seekFirst moves c to the first key not before prefix and from.
+func seekFirst(c *bolt.Cursor, prefix, from []byte) ([]byte, []byte) {
+	if bytes.Compare(prefix, from) > 0 {
+		from = prefix
+	}
+	if from == nil {
+		return c.First()
+	}
+	return c.Seek(from)
+}
+
+// seekLast moves c to the last key not after to, nor after the keys
+// starting with prefix.
+func seekLast(c *bolt.Cursor, prefix, to []byte) ([]byte, []byte) {
+	var k, v []byte
+	if end := prefixEnd(prefix); end != nil && (to == nil || bytes.Compare(end, to) <= 0) {
+		// end is the first key after the ones with the prefix.
+		if k, v = c.Seek(end); k == nil {
+			return c.Last()
+		}
+		return c.Prev()
+	}
+	if to == nil {
+		return c.Last()
+	}
+	if k, v = c.Seek(to); k == nil {
+		return c.Last()
+	}
+	if bytes.Compare(k, to) > 0 {
+		return c.Prev()
+	}
+	return k, v
+}
+
+// prefixEnd returns the smallest key greater than all the keys starting
+// with prefix, or nil if there is none.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
@@ -8,7 +8,8 @@ import (
 )
 
 func init() {
-	registerMetaTable(TypeDB, dbFuncs)
+	registerMetaTable(TypeDB, dbFuncs, dbMethods)
+	registerMetaTable(TypeReadOnlyDB, readOnlyDBFuncs, readOnlyDBMethods())
 }
 
 var dbFuncs = []lua.RegistryFunction{
@@ -30,114 +31,6 @@ var dbFuncs = []lua.RegistryFunction{
 				l.PushString(db.MaxBatchDelay.String())
 			case "alloc_size":
 				l.PushInteger(db.AllocSize)
-			case "batch":
-				l.PushGoFunction(func(l *lua.State) int {
-					lua.CheckType(l, 1, lua.TypeFunction)
-					err := db.Batch(func(tx *bolt.Tx) error {
-						l.PushValue(1)
-						l.PushUserData(tx)
-						lua.SetMetaTableNamed(l, TypeTx)
-						l.Call(1, 0)
-						return nil
-					})
-					if err != nil {
-						lua.Errorf(l, err.Error())
-						panic("unreachable")
-					}
-					return 0
-				})
-			case "begin":
-				l.PushGoFunction(func(l *lua.State) int {
-					lua.CheckType(l, 1, lua.TypeBoolean)
-					writable := l.ToBoolean(3)
-					tx, err := db.Begin(writable)
-					if err != nil {
-						lua.Errorf(l, err.Error())
-						panic("unreachable")
-					}
-					l.PushUserData(tx)
-					lua.SetMetaTableNamed(l, TypeTx)
-					return 1
-				})
-			case "close":
-				l.PushGoFunction(func(l *lua.State) int {
-					if err := db.Close(); err != nil {
-						lua.Errorf(l, err.Error())
-						panic("unreachable")
-					}
-					return 0
-				})
-			case "go_string":
-				l.PushGoFunction(func(l *lua.State) int {
-					l.PushString(db.GoString())
-					return 1
-				})
-			case "info":
-				l.PushGoFunction(func(l *lua.State) int {
-					l.PushUserData(db.Info())
-					lua.SetMetaTableNamed(l, TypeInfo)
-					return 1
-				})
-			case "is_read_only":
-				l.PushGoFunction(func(l *lua.State) int {
-					l.PushBoolean(db.IsReadOnly())
-					return 1
-				})
-			case "path":
-				l.PushGoFunction(func(l *lua.State) int {
-					l.PushString(db.Path())
-					return 1
-				})
-			case "stats":
-				l.PushGoFunction(func(l *lua.State) int {
-					stats := db.Stats()
-					l.PushUserData(&stats)
-					lua.SetMetaTableNamed(l, TypeStats)
-					return 1
-				})
-			case "string":
-				l.PushGoFunction(func(l *lua.State) int {
-					l.PushString(db.String())
-					return 1
-				})
-			case "sync":
-				l.PushGoFunction(func(l *lua.State) int {
-					if err := db.Sync(); err != nil {
-						lua.Errorf(l, err.Error())
-						panic("unreachable")
-					}
-					return 0
-				})
-			case "update":
-				l.PushGoFunction(func(l *lua.State) int {
-					lua.CheckType(l, 1, lua.TypeFunction)
-					err := db.Update(func(tx *bolt.Tx) error {
-						l.PushUserData(tx)
-						lua.SetMetaTableNamed(l, TypeTx)
-						l.Call(1, 0)
-						return nil
-					})
-					if err != nil {
-						lua.Errorf(l, err.Error())
-						panic("unreachable")
-					}
-					return 0
-				})
-			case "view":
-				l.PushGoFunction(func(l *lua.State) int {
-					lua.CheckType(l, 1, lua.TypeFunction)
-					err := db.View(func(tx *bolt.Tx) error {
-						l.PushUserData(tx)
-						lua.SetMetaTableNamed(l, TypeTx)
-						l.Call(1, 0)
-						return nil
-					})
-					if err != nil {
-						lua.Errorf(l, err.Error())
-						panic("unreachable")
-					}
-					return 0
-				})
 			default:
 				lua.Errorf(l, "bolt: unknown DB.%s", k)
 				panic("unreachable")
@@ -183,3 +76,195 @@ var dbFuncs = []lua.RegistryFunction{
 		},
 	},
 }
+
+var dbMethods = []lua.RegistryFunction{
+	{
+		"batch", func(l *lua.State) int {
+			db := CheckDB(l, 1)
+			lua.CheckType(l, 2, lua.TypeFunction)
+			checkInterrupt(l)
+			if !allowed(l, CapWrite) {
+				return fail(l, "DB.batch", ErrPermission)
+			}
+			if err := checkNested(l, db, true); err != nil {
+				return fail(l, "DB.batch", err)
+			}
+			f := newTxCallback(l, "DB.batch", 2)
+			return f.result(db.Batch(f.callBatch))
+		},
+	},
+	{
+		"begin", func(l *lua.State) int {
+			db, readOnly := checkDB(l, 1)
+			lua.CheckType(l, 2, lua.TypeBoolean)
+			writable := l.ToBoolean(2)
+			checkInterrupt(l)
+			if writable && (readOnly || !allowed(l, CapWrite)) {
+				return fail(l, "DB.begin", ErrPermission)
+			}
+			if err := checkNested(l, db, writable); err != nil {
+				return fail(l, "DB.begin", err)
+			}
+			tx, err := db.Begin(writable)
+			if err != nil {
+				return fail(l, "DB.begin", err)
+			}
+			pushTx(l, beginTx(l, tx, readOnly))
+			return 1
+		},
+	},
+	{
+		"close", func(l *lua.State) int {
+			db := CheckDB(l, 1)
+			var err error
+			switch {
+			case untrackDB(l, db):
+				delete(stateResources(l).codecs, db)
+				err = releaseDB(db)
+			case isSharedDB(db):
+				// Opened by other states, or by the host.
+				err = ErrPermission
+			default:
+				err = db.Close()
+			}
+			if err != nil {
+				return fail(l, "DB.close", err)
+			}
+			l.PushBoolean(true)
+			return 1
+		},
+	},
+	{
+		"go_string", func(l *lua.State) int {
+			db := CheckDB(l, 1)
+			l.PushString(db.GoString())
+			return 1
+		},
+	},
+	{
+		"info", func(l *lua.State) int {
+			db, _ := checkDB(l, 1)
+			l.PushUserData(db.Info())
+			lua.SetMetaTableNamed(l, TypeInfo)
+			return 1
+		},
+	},
+	{
+		"is_read_only", func(l *lua.State) int {
+			db := CheckDB(l, 1)
+			l.PushBoolean(db.IsReadOnly())
+			return 1
+		},
+	},
+	{
+		"path", func(l *lua.State) int {
+			db, _ := checkDB(l, 1)
+			l.PushString(db.Path())
+			return 1
+		},
+	},
+	{
+		"stats", func(l *lua.State) int {
+			db, _ := checkDB(l, 1)
+			PushStats(l, db.Stats())
+			return 1
+		},
+	},
+	{
+		"string", func(l *lua.State) int {
+			db := CheckDB(l, 1)
+			l.PushString(db.String())
+			return 1
+		},
+	},
+	{
+		"sync", func(l *lua.State) int {
+			db := CheckDB(l, 1)
+			if err := db.Sync(); err != nil {
+				return fail(l, "DB.sync", err)
+			}
+			l.PushBoolean(true)
+			return 1
+		},
+	},
+	{
+		"update", func(l *lua.State) int {
+			db := CheckDB(l, 1)
+			lua.CheckType(l, 2, lua.TypeFunction)
+			checkInterrupt(l)
+			if !allowed(l, CapWrite) {
+				return fail(l, "DB.update", ErrPermission)
+			}
+			if err := checkNested(l, db, true); err != nil {
+				return fail(l, "DB.update", err)
+			}
+			f := newTxCallback(l, "DB.update", 2)
+			return f.result(db.Update(f.callTx))
+		},
+	},
+	{
+		"view", func(l *lua.State) int {
+			db, readOnly := checkDB(l, 1)
+			lua.CheckType(l, 2, lua.TypeFunction)
+			checkInterrupt(l)
+			if err := checkNested(l, db, false); err != nil {
+				return fail(l, "DB.view", err)
+			}
+			f := newTxCallback(l, "DB.view", 2)
+			f.readOnly = readOnly
+			return f.result(db.View(f.callTx))
+		},
+	},
+}
+
+// readOnlyDBFuncs are the metamethods of a read-only DB, which denies
+// access to all the fields.
+var readOnlyDBFuncs = []lua.RegistryFunction{
+	{
+		"__index", func(l *lua.State) int {
+			lua.CheckUserData(l, 1, TypeReadOnlyDB)
+			k := lua.CheckString(l, 2)
+			raise(l, "DB."+k, ErrPermission)
+			panic("unreachable")
+		},
+	},
+	{
+		"__newindex", func(l *lua.State) int {
+			lua.CheckUserData(l, 1, TypeReadOnlyDB)
+			k := lua.CheckString(l, 2)
+			raise(l, "DB."+k, ErrPermission)
+			panic("unreachable")
+		},
+	},
+}
+
+// readOnlyDBMethods returns the methods of a read-only DB: the methods of
+// a DB which don't change the database, begin denying write transactions.
+func readOnlyDBMethods() []lua.RegistryFunction {
+	var methods []lua.RegistryFunction
+	for _, m := range dbMethods {
+		switch m.Name {
+		case "begin", "info", "path", "stats", "view":
+			methods = append(methods, m)
+		}
+	}
+	return methods
+}
+
+// checkDB returns the DB at index, and whether it is a read-only DB.
+func checkDB(l *lua.State, index int) (*bolt.DB, bool) {
+	if db, ok := lua.TestUserData(l, index, TypeReadOnlyDB).(*bolt.DB); ok {
+		return db, true
+	}
+	return CheckDB(l, index), false
+}
+
+// pushDB pushes db, as a read-only DB if readOnly is set.
+func pushDB(l *lua.State, db *bolt.DB, readOnly bool) {
+	l.PushUserData(db)
+	if readOnly {
+		lua.SetMetaTableNamed(l, TypeReadOnlyDB)
+	} else {
+		lua.SetMetaTableNamed(l, TypeDB)
+	}
+}
@@ -0,0 +1,154 @@
+package luabolt
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Shopify/go-lua"
+	"github.com/boltdb/bolt"
+)
+
+// ErrEngineClosed is returned by Engine.Run once the engine is closed.
+var ErrEngineClosed = errors.New("luabolt: engine closed")
+
+// Engine runs scripts against a database from concurrent goroutines, in a
+// bounded pool of Lua states. Each state has the standard libraries and
+// the bolt module opened, or the libraries opened by the function given
+// to NewEngineWith, and the database as the db global.
+//
+// Each run has its own global environment, which falls back to the
+// globals of the state: the globals a script assigns aren't seen by the
+// following runs. The runs aren't isolated otherwise: the changes made to
+// the globals through _G, or to the tables of the state like those of the
+// libraries, are seen by the following runs in the same state.
+type Engine struct {
+	db   *bolt.DB
+	pool *Pool
+
+	mu     sync.RWMutex
+	closed bool
+
+	// accessed atomically
+	runs     int64
+	failures int64
+}
+
+// EngineStats are statistics on the use of an engine.
+type EngineStats struct {
+	Pool     PoolStats
+	Runs     int // number of scripts run
+	Failures int // number of runs which returned an error
+}
+
+// NewEngine returns an engine running scripts against db, in at most size
+// Lua states. The engine owns db, and closes it when it is closed: the
+// scripts get an ERR_PERMISSION error closing it, and bolt.open on its
+// path returns it.
+func NewEngine(db *bolt.DB, size int) *Engine {
+	return NewEngineWith(db, size, func() (*lua.State, error) {
+		l := lua.NewState()
+		lua.OpenLibraries(l)
+		Open(l)
+		return l, nil
+	})
+}
+
+// NewEngineWith is like NewEngine, except that the states are created by
+// newState, which opens their libraries and the bolt module, for instance
+// with NewSandboxedState for untrusted scripts. The engine sets the db
+// global of the states.
+func NewEngineWith(db *bolt.DB, size int, newState func() (*lua.State, error)) *Engine {
+	hostDB(db)
+	e := &Engine{db: db}
+	e.pool = NewPool(size, func() (*lua.State, error) {
+		l, err := newState()
+		if err != nil {
+			return nil, err
+		}
+		PushDB(l, db, "db")
+		return l, nil
+	})
+	return e
+}
+
+// DB returns the database of the engine.
+func (e *Engine) DB() *bolt.DB {
+	return e.db
+}
+
+// Run runs the script src with args, and returns its results. It waits
+// for a state of the pool to be available, until ctx is done, and aborts
+// the script once ctx is done (see SetContext).
+//
+// The script gets args as the values of its ... expression. The args and
+// results are converted like by Exec.
+//
+// The transactions and databases left open by the script are closed, and
+// reported in a *LeakError, if the script didn't fail otherwise.
+func (e *Engine) Run(ctx context.Context, src string, args ...interface{}) ([]interface{}, error) {
+	return e.RunWithLimits(ctx, Limits{}, src, args...)
+}
+
+// RunWithLimits is like Run, and also aborts the script once it exceeds
+// limits.
+func (e *Engine) RunWithLimits(ctx context.Context, limits Limits, src string, args ...interface{}) ([]interface{}, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.closed {
+		return nil, ErrEngineClosed
+	}
+	l, err := e.pool.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&e.runs, 1)
+	stop := SetContext(l, ctx, limits)
+	results, err := run(l, src, args)
+	stop()
+	if perr := e.pool.Put(l); err == nil {
+		err = perr
+	}
+	if err != nil {
+		atomic.AddInt64(&e.failures, 1)
+	}
+	return results, err
+}
+
+// run runs src in l, in a new global environment.
+func run(l *lua.State, src string, args []interface{}) ([]interface{}, error) {
+	top := l.Top()
+	defer l.SetTop(top)
+	if err := lua.LoadString(l, src); err != nil {
+		return nil, err
+	}
+	l.NewTable()
+	l.NewTable()
+	l.PushGlobalTable()
+	l.SetField(-2, "__index")
+	l.SetMetaTable(-2)
+	lua.SetUpValue(l, -2, 1)
+	return DefaultConversion.call(l, top, 0, args)
+}
+
+// Stats returns statistics on the use of the engine.
+func (e *Engine) Stats() EngineStats {
+	return EngineStats{
+		Pool:     e.pool.Stats(),
+		Runs:     int(atomic.LoadInt64(&e.runs)),
+		Failures: int(atomic.LoadInt64(&e.failures)),
+	}
+}
+
+// Close waits for the running scripts to end, then closes the database.
+func (e *Engine) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return ErrEngineClosed
+	}
+	e.closed = true
+	releaseHostDB(e.db)
+	return e.db.Close()
+}
@@ -0,0 +1,181 @@
+package luabolt
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Shopify/go-lua"
+	"github.com/boltdb/bolt"
+)
+
+func init() {
+	registerMetaTable(TypeError, errorFuncs, nil)
+}
+
+// Error codes, exposed to Lua as the bolt.ERR_* constants.
+const (
+	ErrCodeUnknown            = "unknown"
+	ErrCodeDatabaseNotOpen    = "database_not_open"
+	ErrCodeDatabaseOpen       = "database_open"
+	ErrCodeInvalid            = "invalid"
+	ErrCodeVersionMismatch    = "version_mismatch"
+	ErrCodeChecksum           = "checksum"
+	ErrCodeTimeout            = "timeout"
+	ErrCodeTxNotWritable      = "tx_not_writable"
+	ErrCodeTxClosed           = "tx_closed"
+	ErrCodeDatabaseReadOnly   = "database_read_only"
+	ErrCodeBucketNotFound     = "bucket_not_found"
+	ErrCodeBucketExists       = "bucket_exists"
+	ErrCodeBucketNameRequired = "bucket_name_required"
+	ErrCodeKeyRequired        = "key_required"
+	ErrCodeKeyTooLarge        = "key_too_large"
+	ErrCodeValueTooLarge      = "value_too_large"
+	ErrCodeIncompatibleValue  = "incompatible_value"
+	ErrCodeTxNested           = "tx_nested"
+	ErrCodeAborted            = "aborted"
+	ErrCodePermission         = "permission"
+	ErrCodeUnknownDB          = "unknown_db"
+)
+
+// errorCodes maps the bolt and luabolt errors to their code and the name
+// of the matching constant in the bolt module.
+var errorCodes = []struct {
+	err  error
+	code string
+	name string
+}{
+	{bolt.ErrDatabaseNotOpen, ErrCodeDatabaseNotOpen, "ERR_DATABASE_NOT_OPEN"},
+	{bolt.ErrDatabaseOpen, ErrCodeDatabaseOpen, "ERR_DATABASE_OPEN"},
+	{bolt.ErrInvalid, ErrCodeInvalid, "ERR_INVALID"},
+	{bolt.ErrVersionMismatch, ErrCodeVersionMismatch, "ERR_VERSION_MISMATCH"},
+	{bolt.ErrChecksum, ErrCodeChecksum, "ERR_CHECKSUM"},
+	{bolt.ErrTimeout, ErrCodeTimeout, "ERR_TIMEOUT"},
+	{bolt.ErrTxNotWritable, ErrCodeTxNotWritable, "ERR_TX_NOT_WRITABLE"},
+	{bolt.ErrTxClosed, ErrCodeTxClosed, "ERR_TX_CLOSED"},
+	{bolt.ErrDatabaseReadOnly, ErrCodeDatabaseReadOnly, "ERR_DATABASE_READ_ONLY"},
+	{bolt.ErrBucketNotFound, ErrCodeBucketNotFound, "ERR_BUCKET_NOT_FOUND"},
+	{bolt.ErrBucketExists, ErrCodeBucketExists, "ERR_BUCKET_EXISTS"},
+	{bolt.ErrBucketNameRequired, ErrCodeBucketNameRequired, "ERR_BUCKET_NAME_REQUIRED"},
+	{bolt.ErrKeyRequired, ErrCodeKeyRequired, "ERR_KEY_REQUIRED"},
+	{bolt.ErrKeyTooLarge, ErrCodeKeyTooLarge, "ERR_KEY_TOO_LARGE"},
+	{bolt.ErrValueTooLarge, ErrCodeValueTooLarge, "ERR_VALUE_TOO_LARGE"},
+	{bolt.ErrIncompatibleValue, ErrCodeIncompatibleValue, "ERR_INCOMPATIBLE_VALUE"},
+	{ErrTxNested, ErrCodeTxNested, "ERR_TX_NESTED"},
+	{ErrPermission, ErrCodePermission, "ERR_PERMISSION"},
+	{ErrUnknownDB, ErrCodeUnknownDB, "ERR_UNKNOWN_DB"},
+	{ErrInstructionLimit, ErrCodeAborted, "ERR_ABORTED"},
+	{context.Canceled, ErrCodeAborted, "ERR_ABORTED"},
+	{context.DeadlineExceeded, ErrCodeAborted, "ERR_ABORTED"},
+	{nil, ErrCodeUnknown, "ERR_UNKNOWN"},
+}
+
+// Error is the error raised by the bolt module. It records the operation
+// that failed and the code of the underlying error.
+//
+// Lua sees it as a bolt.Error userdata with the code, message and op fields.
+type Error struct {
+	Code string
+	Op   string
+	Err  error
+}
+
+// NewError returns an Error for err, as returned by op.
+func NewError(op string, err error) *Error {
+	code := ErrCodeUnknown
+	for _, c := range errorCodes {
+		if c.err != nil && errors.Is(err, c.err) {
+			code = c.code
+			break
+		}
+	}
+	return &Error{Code: code, Op: op, Err: err}
+}
+
+func (e *Error) Error() string {
+	return "bolt: " + e.Op + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// raise raises err as a bolt.Error, reported as returned by op.
+func raise(l *lua.State, op string, err error) {
+	e, ok := err.(*Error)
+	if !ok {
+		e = NewError(op, err)
+	}
+	pushError(l, e)
+	// go-lua only raises string values through l.Error, so throw the
+	// error object the same way it does, with the value on top of the stack.
+	panic(e)
+}
+
+// fail reports err, as returned by op, from a method. It raises a
+// bolt.Error, unless the module was opened with OpenSafe: nil and the
+// bolt.Error are then pushed, and fail returns their count.
+func fail(l *lua.State, op string, err error) int {
+	if !isSafe(l) {
+		raise(l, op, err)
+	}
+	e, ok := err.(*Error)
+	if !ok {
+		e = NewError(op, err)
+	}
+	l.PushNil()
+	pushError(l, e)
+	return 2
+}
+
+// rethrow raises again the error value left on top of the stack by a
+// failed ProtectedCall, err being the error it returned.
+func rethrow(l *lua.State, err error) {
+	if e, ok := err.(*Error); ok {
+		panic(e)
+	}
+	l.Error()
+}
+
+func pushError(l *lua.State, e *Error) {
+	l.PushUserData(e)
+	lua.SetMetaTableNamed(l, TypeError)
+}
+
+// toError returns the error for the Lua value at index, which is either a
+// bolt.Error or a value converted to an error message.
+func toError(l *lua.State, index int) error {
+	if e, ok := lua.TestUserData(l, index, TypeError).(*Error); ok {
+		return e
+	}
+	msg, _ := lua.ToStringMeta(l, index)
+	l.Pop(1)
+	return errors.New(msg)
+}
+
+var errorFuncs = []lua.RegistryFunction{
+	{
+		"__index", func(l *lua.State) int {
+			e := lua.CheckUserData(l, 1, TypeError).(*Error)
+			switch k := lua.CheckString(l, 2); k {
+			case "code":
+				l.PushString(e.Code)
+			case "message":
+				l.PushString(e.Err.Error())
+			case "op":
+				l.PushString(e.Op)
+			default:
+				lua.Errorf(l, "bolt: unknown Error.%s", k)
+				panic("unreachable")
+			}
+			return 1
+		},
+	},
+	{
+		"__tostring", func(l *lua.State) int {
+			e := lua.CheckUserData(l, 1, TypeError).(*Error)
+			l.PushString(e.Error())
+			return 1
+		},
+	},
+}
@@ -10,7 +10,7 @@ import (
 	"github.com/vincent-petithory/luabolt"
 )
 
-func ExampleExistingDB() {
+func Example_existingDB() {
 	f, _ := ioutil.TempFile("", "bolt-")
 	_ = f.Close()
 	_ = os.Remove(f.Name())
@@ -0,0 +1,78 @@
+package luabolt
+
+import (
+	"github.com/Shopify/go-lua"
+	"github.com/boltdb/bolt"
+)
+
+// Exec runs the script src in l, with db and args, and returns its
+// results. It uses DefaultConversion.
+//
+// The script gets db, then args, as the values of its ... expression:
+//
+//	local db, name = ...
+func Exec(l *lua.State, db *bolt.DB, src string, args ...interface{}) ([]interface{}, error) {
+	return DefaultConversion.Exec(l, db, src, args...)
+}
+
+// ExecTx is like Exec, but gives the script tx instead of a database. It
+// uses DefaultConversion.
+func ExecTx(l *lua.State, tx *bolt.Tx, src string, args ...interface{}) ([]interface{}, error) {
+	return DefaultConversion.ExecTx(l, tx, src, args...)
+}
+
+// Exec is like the Exec function, and converts the results with c.
+func (c Conversion) Exec(l *lua.State, db *bolt.DB, src string, args ...interface{}) ([]interface{}, error) {
+	if db == nil {
+		panic("db is nil")
+	}
+	top := l.Top()
+	defer l.SetTop(top)
+	if err := lua.LoadString(l, src); err != nil {
+		return nil, err
+	}
+	PushDBValue(l, db)
+	return c.call(l, top, 1, args)
+}
+
+// ExecTx is like the ExecTx function, and converts the results with c.
+//
+// The transaction belongs to the caller: the script can't commit or roll
+// it back, nor use it once ExecTx returned.
+func (c Conversion) ExecTx(l *lua.State, tx *bolt.Tx, src string, args ...interface{}) ([]interface{}, error) {
+	if tx == nil {
+		panic("tx is nil")
+	}
+	top := l.Top()
+	defer l.SetTop(top)
+	if err := lua.LoadString(l, src); err != nil {
+		return nil, err
+	}
+	h := &txHandle{&txState{tx: tx, managed: true}}
+	trackTx(l, h.txState)
+	defer h.close()
+	pushTx(l, h)
+	return c.call(l, top, 1, args)
+}
+
+// call calls the function at top+1, with the nargs values above it and
+// args, and returns its results.
+func (c Conversion) call(l *lua.State, top, nargs int, args []interface{}) ([]interface{}, error) {
+	for _, arg := range args {
+		if err := pushValue(l, arg); err != nil {
+			return nil, err
+		}
+	}
+	if err := l.ProtectedCall(nargs+len(args), lua.MultipleReturns, 0); err != nil {
+		return nil, err
+	}
+	var results []interface{}
+	for i := top + 1; i <= l.Top(); i++ {
+		v, err := c.toValue(l, i)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, v)
+	}
+	return results, nil
+}
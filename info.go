@@ -6,7 +6,7 @@ import (
 )
 
 func init() {
-	registerMetaTable(TypeInfo, infoFuncs)
+	registerMetaTable(TypeInfo, infoFuncs, nil)
 }
 
 var infoFuncs = []lua.RegistryFunction{
@@ -0,0 +1,102 @@
+package luabolt
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/Shopify/go-lua"
+)
+
+// ErrInstructionLimit is the error of a script aborted because it ran
+// more instructions than allowed by its Limits.
+var ErrInstructionLimit = errors.New("instruction limit exceeded")
+
+// Limits bound the execution of a script. A zero value means no limit.
+type Limits struct {
+	// Instructions is the number of Lua instructions the script may run.
+	Instructions int
+	// Duration is the time the script may run.
+	Duration time.Duration
+}
+
+// hookCount is the number of instructions between two checks of a script.
+const hookCount = 1000
+
+// SetContext aborts the scripts run in l once ctx is done or they exceed
+// limits, until the returned function is called.
+//
+// The script is aborted within a few Lua instructions, or when it starts
+// a transaction, with an ERR_ABORTED bolt.Error which unwraps to the error
+// of ctx or ErrInstructionLimit. The transactions begun with DB.begin are
+// rolled back, and those run by DB.update, DB.view and DB.batch are rolled
+// back as the error unwinds them. Once aborted, the script can't resume:
+// the error is raised again if it is caught.
+func SetContext(l *lua.State, ctx context.Context, limits Limits) func() {
+	cancel := func() {}
+	if limits.Duration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, limits.Duration)
+	}
+	if ctx.Done() == nil && limits.Instructions <= 0 {
+		return cancel
+	}
+	i := &interrupt{ctx: ctx, limit: limits.Instructions, count: hookCount}
+	if i.limit > 0 && i.limit < i.count {
+		i.count = i.limit
+	}
+	r := stateResources(l)
+	r.interrupt = i
+	// go-lua doesn't support raising errors from call hooks: bindings
+	// which start a transaction check the interrupt themselves.
+	lua.SetDebugHook(l, i.hook, lua.MaskCount, i.count)
+	return func() {
+		lua.SetDebugHook(l, nil, 0, 0)
+		r.interrupt = nil
+		cancel()
+	}
+}
+
+// interrupt aborts a script once its context is done, or it ran more
+// instructions than its limit.
+type interrupt struct {
+	ctx   context.Context
+	limit int
+	count int
+	ran   int
+	err   error
+}
+
+func (i *interrupt) hook(l *lua.State, d lua.Debug) {
+	i.ran += i.count
+	i.check(l)
+}
+
+// check raises the error aborting the script, if any.
+//
+// The first time, the transactions begun by the script are rolled back,
+// and the hook is then called for each instruction: the error is raised
+// again right after a pcall catches it, until it reaches the host.
+func (i *interrupt) check(l *lua.State) {
+	if i.err == nil {
+		if err := i.ctx.Err(); err != nil {
+			i.err = err
+		} else if i.limit > 0 && i.ran >= i.limit {
+			i.err = ErrInstructionLimit
+		} else {
+			return
+		}
+		for _, s := range stateResources(l).openTxs() {
+			s.rollbackLeaked()
+		}
+		i.count = 1
+		lua.SetDebugHook(l, i.hook, lua.MaskCount, i.count)
+	}
+	raise(l, "run", i.err)
+}
+
+// checkInterrupt raises the error aborting the script run in l, if any.
+func checkInterrupt(l *lua.State) {
+	if i := stateResources(l).interrupt; i != nil {
+		i.check(l)
+	}
+}
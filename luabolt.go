@@ -9,14 +9,226 @@ import (
 
 var registryMTFuncs []func(*lua.State)
 
-func registerMetaTable(name string, funcs []lua.RegistryFunction) {
+// metaType holds the methods and the field hooks of a type registered
+// with registerMetaTable.
+type metaType struct {
+	methods map[string]lua.Function
+	getters map[string]lua.Function
+	setters map[string]lua.Function
+	// builtins are the built-in methods, restored by Unregister.
+	builtins map[string]lua.Function
+}
+
+var metaTypes = make(map[string]*metaType)
+
+// registerMetaTable registers the metatable of the type name, with the
+// metamethods funcs and the methods.
+//
+// Methods take their receiver as first argument. They are looked up before
+// the fields handled by the __index metamethod in funcs.
+func registerMetaTable(name string, funcs []lua.RegistryFunction, methods []lua.RegistryFunction) {
+	t := &metaType{
+		methods:  make(map[string]lua.Function, len(methods)),
+		getters:  make(map[string]lua.Function),
+		setters:  make(map[string]lua.Function),
+		builtins: make(map[string]lua.Function, len(methods)),
+	}
+	for _, method := range methods {
+		t.methods[method.Name] = bindMethod(method.Function)
+		t.builtins[method.Name] = t.methods[method.Name]
+	}
+	metaTypes[name] = t
+	var fields, setFields lua.Function
+	for _, f := range funcs {
+		switch f.Name {
+		case "__index":
+			fields = f.Function
+		case "__newindex":
+			setFields = f.Function
+		}
+	}
+	index := t.index(fields)
+	newIndex := t.newIndex(name, setFields)
 	registryMTFuncs = append(registryMTFuncs, func(l *lua.State) {
 		lua.NewMetaTable(l, name)
 		lua.SetFunctions(l, funcs, 0)
+		l.PushGoFunction(index)
+		l.SetField(-2, "__index")
+		if setFields != nil || len(t.setters) > 0 {
+			l.PushGoFunction(newIndex)
+			l.SetField(-2, "__newindex")
+		}
+		l.Pop(1)
 	})
 }
 
+// RegisterMethod adds the method name to the type typeName, one of the
+// Type* constants, or replaces the method or field of that name.
+//
+// Like the built-in methods, f is called with its receiver as first
+// argument, whether the method is called with the dot or colon syntax.
+//
+// RegisterMethod, RegisterGetter and RegisterSetter must be called before
+// the bolt module is opened in a Lua state, usually from an init function.
+func RegisterMethod(typeName, name string, f lua.Function) {
+	t := lookupMetaType(typeName)
+	delete(t.getters, name)
+	t.methods[name] = bindMethod(f)
+}
+
+// RegisterGetter adds the field name to the type typeName, or replaces
+// the method or field of that name. Reading the field calls f like an
+// __index metamethod, with the userdata and the field name.
+func RegisterGetter(typeName, name string, f lua.Function) {
+	t := lookupMetaType(typeName)
+	delete(t.methods, name)
+	t.getters[name] = f
+}
+
+// RegisterSetter adds the settable field name to the type typeName, or
+// replaces the setter of that field. Setting the field calls f like a
+// __newindex metamethod, with the userdata, the field name and the value.
+func RegisterSetter(typeName, name string, f lua.Function) {
+	t := lookupMetaType(typeName)
+	t.setters[name] = f
+}
+
+// Unregister removes the method or field name added to the type typeName
+// with RegisterMethod, RegisterGetter or RegisterSetter, and restores the
+// built-in method of that name, if any. Like them, it must be called
+// before the bolt module is opened in a Lua state.
+func Unregister(typeName, name string) {
+	t := lookupMetaType(typeName)
+	delete(t.getters, name)
+	delete(t.setters, name)
+	if m, ok := t.builtins[name]; ok {
+		t.methods[name] = m
+	} else {
+		delete(t.methods, name)
+	}
+}
+
+func lookupMetaType(typeName string) *metaType {
+	t, ok := metaTypes[typeName]
+	if !ok {
+		panic("unknown type " + typeName)
+	}
+	return t
+}
+
+// index returns an __index metamethod which looks up methods, then the
+// fields registered with RegisterGetter, and otherwise calls fields.
+//
+// A method is bound to its receiver on first access, and the bound method
+// is cached in the user value of the receiver: the following accesses
+// don't allocate.
+func (t *metaType) index(fields lua.Function) lua.Function {
+	return func(l *lua.State) int {
+		if !l.IsUserData(1) {
+			return fields(l)
+		}
+		l.UserValue(1)
+		cached := l.IsTable(3)
+		if cached {
+			l.PushValue(2)
+			l.RawGet(3)
+			if !l.IsNil(4) {
+				return 1
+			}
+			l.Pop(1)
+		}
+		if l.TypeOf(2) == lua.TypeString {
+			k, _ := l.ToString(2)
+			if f, ok := t.methods[k]; ok {
+				if !cached {
+					l.Pop(1)
+					l.NewTable()
+					l.PushValue(3)
+					l.SetUserValue(1)
+				}
+				l.PushValue(2)
+				l.PushValue(1)
+				l.PushGoClosure(f, 1)
+				l.PushValue(-1)
+				l.Insert(4)
+				l.RawSet(3)
+				return 1
+			}
+			if f, ok := t.getters[k]; ok {
+				l.SetTop(2)
+				return f(l)
+			}
+		}
+		l.SetTop(2)
+		return fields(l)
+	}
+}
+
+// newIndex returns a __newindex metamethod which calls the setters
+// registered with RegisterSetter, and otherwise setFields.
+func (t *metaType) newIndex(name string, setFields lua.Function) lua.Function {
+	return func(l *lua.State) int {
+		if l.TypeOf(2) == lua.TypeString {
+			k, _ := l.ToString(2)
+			if f, ok := t.setters[k]; ok {
+				return f(l)
+			}
+		}
+		if setFields == nil {
+			k, _ := lua.ToStringMeta(l, 2)
+			lua.Errorf(l, "bolt: can't set field %s", k)
+			panic("unreachable")
+		}
+		return setFields(l)
+	}
+}
+
+// bindMethod returns a closure of f bound to the receiver in its first
+// upvalue. The receiver is passed to f as first argument when the closure
+// is called with the dot syntax, so that both recv.f(...) and recv:f(...)
+// work.
+//
+// A method called with the dot syntax and its own receiver as first
+// argument is seen as called with the colon syntax.
+func bindMethod(f lua.Function) lua.Function {
+	return func(l *lua.State) int {
+		if !l.RawEqual(1, lua.UpValueIndex(1)) {
+			l.PushValue(lua.UpValueIndex(1))
+			l.Insert(1)
+		}
+		return f(l)
+	}
+}
+
 func Open(l *lua.State) {
+	OpenWith(l, Config{})
+}
+
+// OpenSafe opens the bolt module like Open, except that its methods don't
+// raise errors: on failure, they return nil and a bolt.Error.
+func OpenSafe(l *lua.State) {
+	OpenWith(l, Config{Safe: true})
+}
+
+// OpenWith opens the bolt module with config. It can be called again on
+// the same state: the module is only created once for each name.
+//
+// The config applies to the whole state, not to the module of its name,
+// since the bolt values are shared by all the modules. OpenWith panics if
+// the state has the bolt module open with another config, except for its
+// Name and Global fields, so that it doesn't lift the restrictions of the
+// config, like those of a sandboxed state.
+func OpenWith(l *lua.State, config Config) {
+	if config.Name == "" {
+		config.Name = "bolt"
+	}
+	if old, ok := openConfig(l); !ok {
+		l.PushUserData(&config)
+		l.SetField(lua.RegistryIndex, configKey)
+	} else if !sameConfig(*old, config) {
+		panic("luabolt: the bolt module is already open with another config")
+	}
+
 	// register metatables
 	for _, f := range registryMTFuncs {
 		f(l)
@@ -25,12 +237,30 @@ func Open(l *lua.State) {
 	lib := func(l *lua.State) int {
 		lua.NewLibrary(l, []lua.RegistryFunction{
 			{"open", boltOpen},
+			{"open_named", boltOpenNamed},
+			{"open_temp", boltOpenTemp},
 			{"const", boltConst},
+			{"options", boltOptions},
 		})
+		for _, c := range errorCodes {
+			l.PushString(c.code)
+			l.SetField(-2, c.name)
+		}
+		l.PushUserData(errStop)
+		l.SetField(-2, "STOP")
 		return 1
 	}
-	lua.Require(l, "bolt", lib, false)
-	l.Pop(1)
+	// lua.Require always creates the module again.
+	lua.SubTable(l, lua.RegistryIndex, "_LOADED")
+	l.Field(-1, config.Name)
+	if l.IsNil(-1) {
+		l.Pop(1)
+		lua.Require(l, config.Name, lib, config.Global)
+	} else if config.Global {
+		l.PushValue(-1)
+		l.SetGlobal(config.Name)
+	}
+	l.Pop(2)
 }
 
 const (
@@ -38,9 +268,11 @@ const (
 	TypeBucketStats = "github.com/boltdb/bolt.BucketStats"
 	TypeCursor      = "github.com/boltdb/bolt.Cursor"
 	TypeDB          = "github.com/boltdb/bolt.DB"
+	TypeError       = "github.com/vincent-petithory/luabolt.Error"
 	TypeInfo        = "github.com/boltdb/bolt.Info"
 	TypeOptions     = "github.com/boltdb/bolt.Options"
 	TypePageInfo    = "github.com/boltdb/bolt.PageInfo"
+	TypeReadOnlyDB  = "github.com/vincent-petithory/luabolt.ReadOnlyDB"
 	TypeStats       = "github.com/boltdb/bolt.Stats"
 	TypeTx          = "github.com/boltdb/bolt.Tx"
 	TypeTxStats     = "github.com/boltdb/bolt.TxStats"
@@ -49,17 +281,57 @@ const (
 var boltOpen = func(l *lua.State) int {
 	path := lua.CheckString(l, 1)
 	mode := lua.CheckUnsigned(l, 2)
-	var options *bolt.Options
+	if !allowed(l, CapOpen) {
+		return fail(l, "open", ErrPermission)
+	}
+	options := stateConfig(l).Options
 	if l.Top() > 2 && !l.IsNil(3) {
-		options = lua.CheckUserData(l, 3, TypeOptions).(*bolt.Options)
+		options = checkOptions(l, 3)
+	}
+	path, err := openPath(l, path, os.FileMode(mode))
+	if err != nil {
+		return fail(l, "open", err)
+	}
+	db, err := acquireDB(path, os.FileMode(mode), options)
+	if err != nil {
+		return fail(l, "open", err)
+	}
+	trackDB(l, db)
+	PushDBValue(l, db)
+	return 1
+}
+
+var boltOpenNamed = func(l *lua.State) int {
+	name := lua.CheckString(l, 1)
+	if !allowed(l, CapOpen) {
+		return fail(l, "open_named", ErrPermission)
+	}
+	db, err := acquireNamedDB(name)
+	if err != nil {
+		return fail(l, "open_named", err)
 	}
-	db, err := bolt.Open(path, os.FileMode(mode), options)
+	trackDB(l, db)
+	PushDBValue(l, db)
+	return 1
+}
+
+var boltOpenTemp = func(l *lua.State) int {
+	if !allowed(l, CapOpen) {
+		return fail(l, "open_temp", ErrPermission)
+	}
+	options := stateConfig(l).Options
+	if l.Top() > 0 && !l.IsNil(1) {
+		options = checkOptions(l, 1)
+	}
+	if err := checkOpenCount(l); err != nil {
+		return fail(l, "open_temp", err)
+	}
+	db, err := acquireTempDB(options)
 	if err != nil {
-		lua.Errorf(l, err.Error())
-		panic("unreachable")
+		return fail(l, "open_temp", err)
 	}
-	l.PushUserData(db)
-	lua.SetMetaTableNamed(l, TypeDB)
+	trackDB(l, db)
+	PushDBValue(l, db)
 	return 1
 }
 
@@ -84,21 +356,104 @@ var boltConst = func(l *lua.State) int {
 }
 
 func PushDB(l *lua.State, db *bolt.DB, varName string) {
+	PushDBValue(l, db)
+	l.SetGlobal(varName)
+}
+
+func PushTx(l *lua.State, tx *bolt.Tx, varName string) {
+	PushTxValue(l, tx)
+	l.SetGlobal(varName)
+}
+
+// PushDBValue pushes db onto the stack.
+func PushDBValue(l *lua.State, db *bolt.DB) {
 	if db == nil {
 		panic("db is nil")
 	}
-	l.PushUserData(db)
-	lua.SetMetaTableNamed(l, TypeDB)
+	pushDB(l, db, false)
+}
+
+// PushDBReadOnly pushes db as a read-only DB and sets it as the global
+// variable varName.
+//
+// A read-only DB only has the view, begin, stats, info and path methods,
+// and begin only starts read-only transactions. Using anything else
+// raises an ERR_PERMISSION error, as well as reading or setting fields.
+// The DB returned by Tx.db, for the transactions of a read-only DB, is
+// read-only too, and their Tx.copy_file method, which writes a file,
+// raises an ERR_PERMISSION error.
+func PushDBReadOnly(l *lua.State, db *bolt.DB, varName string) {
+	PushDBReadOnlyValue(l, db)
 	l.SetGlobal(varName)
 }
 
-func PushTx(l *lua.State, tx *bolt.Tx, varName string) {
+// PushDBReadOnlyValue pushes db as a read-only DB onto the stack.
+func PushDBReadOnlyValue(l *lua.State, db *bolt.DB) {
+	if db == nil {
+		panic("db is nil")
+	}
+	pushDB(l, db, true)
+}
+
+// PushTxValue pushes tx onto the stack. The transaction belongs to the
+// caller, though the script may commit or roll it back.
+func PushTxValue(l *lua.State, tx *bolt.Tx) {
 	if tx == nil {
 		panic("tx is nil")
 	}
-	l.PushUserData(tx)
-	lua.SetMetaTableNamed(l, TypeTx)
-	l.SetGlobal(varName)
+	pushTx(l, hostTx(l, tx))
+}
+
+// PushBucket pushes b onto the stack. The bucket can't be used once its
+// transaction is closed by the script. Since the name of b isn't known,
+// the codec set on its codec field is only kept by the value pushed.
+func PushBucket(l *lua.State, b *bolt.Bucket) {
+	if b == nil {
+		panic("bucket is nil")
+	}
+	pushBucket(l, b, hostTx(l, b.Tx()), nil)
+}
+
+// PushCursor pushes c onto the stack. The cursor can't be used once its
+// transaction is closed by the script.
+func PushCursor(l *lua.State, c *bolt.Cursor) {
+	if c == nil {
+		panic("cursor is nil")
+	}
+	pushCursor(l, c, hostTx(l, c.Bucket().Tx()), nil)
+}
+
+// PushStats pushes a copy of stats onto the stack.
+func PushStats(l *lua.State, stats bolt.Stats) {
+	l.PushUserData(&stats)
+	lua.SetMetaTableNamed(l, TypeStats)
+}
+
+// CheckDB returns the DB at index. It raises an error if the value isn't a
+// DB, including if it is a read-only DB.
+func CheckDB(l *lua.State, index int) *bolt.DB {
+	return lua.CheckUserData(l, index, TypeDB).(*bolt.DB)
+}
+
+// CheckTx returns the Tx at index. It raises an error if the value isn't a
+// Tx, or if the transaction is closed.
+func CheckTx(l *lua.State, index int) *bolt.Tx {
+	tx, _ := checkTx(l, index)
+	return tx
+}
+
+// CheckBucket returns the Bucket at index. It raises an error if the value
+// isn't a Bucket, or if its transaction is closed.
+func CheckBucket(l *lua.State, index int) *bolt.Bucket {
+	b, _ := checkBucket(l, index)
+	return b
+}
+
+// CheckCursor returns the Cursor at index. It raises an error if the value
+// isn't a Cursor, or if its transaction is closed.
+func CheckCursor(l *lua.State, index int) *bolt.Cursor {
+	c, _ := checkCursor(l, index)
+	return c
 }
 
 func pushBytes(l *lua.State, v []byte) {
@@ -114,3 +469,43 @@ func checkBytes(l *lua.State, index int) []byte {
 	s := lua.CheckString(l, index)
 	return []byte(s)
 }
+
+// refsKey is the registry field of the table holding the values
+// referenced by ref.
+const refsKey = "github.com/vincent-petithory/luabolt.refs"
+
+// ref stores the value at index in the registry, and returns a reference
+// to it for pushRef.
+func ref(l *lua.State, index int) int {
+	index = l.AbsIndex(index)
+	lua.SubTable(l, lua.RegistryIndex, refsKey)
+	r := 1
+	for {
+		l.RawGetInt(-1, r)
+		free := l.IsNil(-1)
+		l.Pop(1)
+		if free {
+			break
+		}
+		r++
+	}
+	l.PushValue(index)
+	l.RawSetInt(-2, r)
+	l.Pop(1)
+	return r
+}
+
+// pushRef pushes the value referenced by r.
+func pushRef(l *lua.State, r int) {
+	lua.SubTable(l, lua.RegistryIndex, refsKey)
+	l.RawGetInt(-1, r)
+	l.Remove(-2)
+}
+
+// unref releases the reference r.
+func unref(l *lua.State, r int) {
+	lua.SubTable(l, lua.RegistryIndex, refsKey)
+	l.PushNil()
+	l.RawSetInt(-2, r)
+	l.Pop(1)
+}
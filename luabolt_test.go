@@ -2,11 +2,17 @@ package luabolt_test
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/Shopify/go-lua"
 	"github.com/boltdb/bolt"
@@ -503,7 +509,7 @@ db.update(function(tx)
   -- trigger error
   ok, err = pcall(function() b.put("cat", "meow") end)
   if not ok then fprintf("got expected error\n") end
-  if string.find(err, "incompatible value") then fprintf("got expected error msg\n") end
+  if string.find(tostring(err), "incompatible value") then fprintf("got expected error msg\n") end
 end)
 `
 	if err := lua.DoString(l, src); err != nil {
@@ -514,3 +520,1854 @@ end)
 		t.Errorf("expected:\n%s\ngot:\n%s", expectedBuf.String(), buf.String())
 	}
 }
+
+func TestTxReturnedError(t *testing.T) {
+	l, db, buf := setupLuaAndDB(t)
+	defer db.Close()
+
+	var expectedBuf bytes.Buffer
+	fmt.Fprintln(&expectedBuf, "update:nil,no arrows left")
+	fmt.Fprintln(&expectedBuf, "non-existing bucket")
+	fmt.Fprintln(&expectedBuf, "update:true")
+	src := `
+local bolt = require("bolt")
+
+ok, err = db.update(function(tx)
+  tx.create_bucket("arrows")
+  return nil, "no arrows left"
+end)
+fprintf("update:%s,%s\n", tostring(ok), err)
+
+db.view(function(tx)
+  b = tx.bucket("arrows")
+  if not b then fprintf("non-existing bucket\n") end
+end)
+
+ok = db.update(function(tx)
+  tx.create_bucket("arrows")
+end)
+fprintf("update:%s\n", tostring(ok))
+`
+	if err := lua.DoString(l, src); err != nil {
+		t.Error(err)
+		return
+	}
+	if buf.String() != expectedBuf.String() {
+		t.Errorf("expected:\n%s\ngot:\n%s", expectedBuf.String(), buf.String())
+	}
+}
+
+func TestErrorObject(t *testing.T) {
+	l, db, buf := setupLuaAndDB(t)
+	defer db.Close()
+
+	var expectedBuf bytes.Buffer
+	fmt.Fprintln(&expectedBuf, "bucket_not_found:true")
+	fmt.Fprintln(&expectedBuf, "op:Tx.delete_bucket")
+	fmt.Fprintln(&expectedBuf, "message:bucket not found")
+	fmt.Fprintln(&expectedBuf, "update:nil,bucket_exists")
+	src := `
+local bolt = require("bolt")
+
+db.update(function(tx)
+  ok, err = pcall(function() tx.delete_bucket("nope") end)
+  fprintf("%s:%t\n", err.code, err.code == bolt.ERR_BUCKET_NOT_FOUND)
+  fprintf("op:%s\n", err.op)
+  fprintf("message:%s\n", err.message)
+end)
+
+ok, err = db.update(function(tx)
+  tx.create_bucket("b")
+  local ok, err = pcall(function() tx.create_bucket("b") end)
+  return nil, err
+end)
+fprintf("update:%s,%s\n", tostring(ok), err.code)
+`
+	if err := lua.DoString(l, src); err != nil {
+		t.Error(err)
+		return
+	}
+	if buf.String() != expectedBuf.String() {
+		t.Errorf("expected:\n%s\ngot:\n%s", expectedBuf.String(), buf.String())
+	}
+
+	err := lua.DoString(l, `db.update(function(tx) tx.create_bucket_if_not_exists("b").put("", "v") end)`)
+	if !errors.Is(err, bolt.ErrKeyRequired) {
+		t.Errorf("expected %v, got %v", bolt.ErrKeyRequired, err)
+	}
+	var e *luabolt.Error
+	if !errors.As(err, &e) || e.Code != luabolt.ErrCodeKeyRequired || e.Op != "Bucket.put" {
+		t.Errorf("unexpected error %#v", err)
+	}
+}
+
+func TestOpenSafe(t *testing.T) {
+	db := NewDB(t)
+	defer db.Close()
+	l := lua.NewState()
+	lua.OpenLibraries(l)
+	var buf bytes.Buffer
+	l.Register("fprintf", func(l *lua.State) int {
+		return fprintf(l, &buf)
+	})
+	luabolt.OpenSafe(l)
+	luabolt.PushDB(l, db.DB, "db")
+
+	var expectedBuf bytes.Buffer
+	fmt.Fprintln(&expectedBuf, "create_bucket:nil,bucket_exists")
+	fmt.Fprintln(&expectedBuf, "put:true")
+	fmt.Fprintln(&expectedBuf, "put:nil,key_required")
+	fmt.Fprintln(&expectedBuf, "view:nil,boom")
+	fmt.Fprintln(&expectedBuf, "open:nil,timeout")
+	src := `
+local bolt = require("bolt")
+
+db.update(function(tx)
+  tx.create_bucket("b")
+  local b, err = tx.create_bucket("b")
+  fprintf("create_bucket:%s,%s\n", tostring(b), err.code)
+  b = tx.bucket("b")
+  fprintf("put:%s\n", tostring(b.put("k", "v")))
+  local ok, err = b.put("", "v")
+  fprintf("put:%s,%s\n", tostring(ok), err.code)
+end)
+
+local ok, err = db.view(function(tx)
+  error("boom", 0)
+end)
+fprintf("view:%s,%s\n", tostring(ok), err)
+
+local opts = bolt_options
+local db2, err = bolt.open(db.path(), tonumber("666", 8), opts)
+fprintf("open:%s,%s\n", tostring(db2), err.code)
+`
+	l.PushUserData(&bolt.Options{Timeout: 10 * time.Millisecond})
+	lua.SetMetaTableNamed(l, luabolt.TypeOptions)
+	l.SetGlobal("bolt_options")
+	if err := lua.DoString(l, src); err != nil {
+		t.Error(err)
+		return
+	}
+	if buf.String() != expectedBuf.String() {
+		t.Errorf("expected:\n%s\ngot:\n%s", expectedBuf.String(), buf.String())
+	}
+}
+
+func TestOptions(t *testing.T) {
+	l, db, buf := setupLuaAndDB(t)
+	defer db.Close()
+
+	var expectedBuf bytes.Buffer
+	fmt.Fprintln(&expectedBuf, "1s:true:false:0:65536")
+	fmt.Fprintln(&expectedBuf, "open:timeout")
+	fmt.Fprintln(&expectedBuf, "unknown:true")
+	fmt.Fprintln(&expectedBuf, "bad type:true")
+	src := `
+local bolt = require("bolt")
+
+local opts = bolt.options{timeout="1s", read_only=true, no_grow_sync=false, mmap_flags=0, initial_mmap_size=65536}
+fprintf("%s:%t:%t:%v:%v\n", opts.timeout, opts.read_only, opts.no_grow_sync, opts.mmap_flags, opts.initial_mmap_size)
+
+local ok, err = pcall(bolt.open, db.path(), tonumber("666", 8), {timeout="10ms"})
+fprintf("open:%s\n", err.code)
+
+ok, err = pcall(bolt.options, {time_out="1s"})
+fprintf("unknown:%t\n", string.find(err, "unknown Options.time_out") ~= nil)
+
+ok, err = pcall(bolt.open, db.path(), tonumber("666", 8), {read_only="yes"})
+fprintf("bad type:%t\n", string.find(err, "bad Options.read_only (boolean expected, got string)", 1, true) ~= nil)
+`
+	if err := lua.DoString(l, src); err != nil {
+		t.Error(err)
+		return
+	}
+	if buf.String() != expectedBuf.String() {
+		t.Errorf("expected:\n%s\ngot:\n%s", expectedBuf.String(), buf.String())
+	}
+}
+
+func TestTxBackup(t *testing.T) {
+	l, db, buf := setupLuaAndDB(t)
+	defer db.Close()
+
+	var w bytes.Buffer
+	l.PushUserData(&w)
+	l.SetGlobal("gowriter")
+	copyPath := tempfile()
+	defer os.Remove(copyPath)
+	l.PushString(copyPath)
+	l.SetGlobal("copy_path")
+	filePath := tempfile()
+	defer os.Remove(filePath)
+	l.PushString(filePath)
+	l.SetGlobal("file_path")
+
+	src := `
+local bolt = require("bolt")
+
+db.update(function(tx)
+  tx.create_bucket("b").put("k", "v")
+end)
+
+db.view(function(tx)
+  local n = tx.write_to(gowriter)
+  fprintf("go:%t\n", n == tx.size())
+  tx.copy_file(copy_path, tonumber("600", 8))
+  local f = io.open(file_path, "wb")
+  n = tx.write_to(f)
+  f:close()
+  fprintf("file:%t\n", n == tx.size())
+  local ok, err = pcall(tx.write_to, 42)
+  fprintf("bad writer:%t\n", not ok)
+end)
+`
+	if err := lua.DoString(l, src); err != nil {
+		t.Error(err)
+		return
+	}
+	if es := "go:true\nfile:true\nbad writer:true\n"; buf.String() != es {
+		t.Errorf("expected:\n%s\ngot:\n%s", es, buf.String())
+	}
+	for _, p := range []string{copyPath, filePath} {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, w.Bytes()) {
+			t.Errorf("%s: backup differs from write_to output", p)
+		}
+		backup, err := bolt.Open(p, 0600, &bolt.Options{ReadOnly: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := backup.View(func(tx *bolt.Tx) error {
+			if v := tx.Bucket([]byte("b")).Get([]byte("k")); string(v) != "v" {
+				t.Errorf("%s: expected v, got %q", p, v)
+			}
+			return nil
+		}); err != nil {
+			t.Error(err)
+		}
+		backup.Close()
+	}
+}
+
+func TestIterators(t *testing.T) {
+	l, db, buf := setupLuaAndDB(t)
+	defer db.Close()
+
+	var expectedBuf bytes.Buffer
+	fmt.Fprintln(&expectedBuf, "pairs:a1,a2,b1,b2,c1,")
+	fmt.Fprintln(&expectedBuf, "pairs_reverse:c1,b2,b1,a2,a1,")
+	fmt.Fprintln(&expectedBuf, "range:a2,b1,b2,")
+	fmt.Fprintln(&expectedBuf, "range_reverse:b2,b1,a2,")
+	fmt.Fprintln(&expectedBuf, "range open:b1,b2,c1,")
+	fmt.Fprintln(&expectedBuf, "prefix:b1,b2,")
+	fmt.Fprintln(&expectedBuf, "prefix_reverse:b2,b1,")
+	fmt.Fprintln(&expectedBuf, "break:a1,a2,")
+	fmt.Fprintln(&expectedBuf, "__pairs:a1=va1,a2=va2,b1=vb1,b2=vb2,c1=vc1,")
+	fmt.Fprintln(&expectedBuf, "tx __pairs:keys,other,")
+	src := `
+local bolt = require("bolt")
+
+local function keys(name, ...)
+  local s = name .. ":"
+  for k, v in ... do
+    s = s .. k .. ","
+  end
+  fprintf("%s\n", s)
+end
+
+db.update(function(tx)
+  local b = tx.create_bucket("keys")
+  for _, k in ipairs({"b1", "a1", "c1", "a2", "b2"}) do
+    b.put(k, "v" .. k)
+  end
+  tx.create_bucket("other")
+end)
+
+db.view(function(tx)
+  local b = tx.bucket("keys")
+  keys("pairs", b:pairs())
+  keys("pairs_reverse", b.pairs_reverse())
+  keys("range", b:range("a2", "b2"))
+  keys("range_reverse", b:range_reverse("a15", "b3"))
+  keys("range open", b.range("b"))
+  keys("prefix", b:prefix("b"))
+  keys("prefix_reverse", b:prefix_reverse("b"))
+
+  local s = "break:"
+  for k in b:pairs() do
+    if k == "b1" then break end
+    s = s .. k .. ","
+  end
+  fprintf("%s\n", s)
+
+  s = "__pairs:"
+  for k, v in pairs(b) do
+    s = s .. k .. "=" .. v .. ","
+  end
+  fprintf("%s\n", s)
+
+  s = "tx __pairs:"
+  for name, bucket in pairs(tx) do
+    if bucket.writable() then error("unexpected writable bucket") end
+    s = s .. name .. ","
+  end
+  fprintf("%s\n", s)
+end)
+`
+	if err := lua.DoString(l, src); err != nil {
+		t.Error(err)
+		return
+	}
+	if buf.String() != expectedBuf.String() {
+		t.Errorf("expected:\n%s\ngot:\n%s", expectedBuf.String(), buf.String())
+	}
+}
+
+func TestForEachStop(t *testing.T) {
+	l, db, buf := setupLuaAndDB(t)
+	defer db.Close()
+
+	var expectedBuf bytes.Buffer
+	fmt.Fprintln(&expectedBuf, "false:a,b,")
+	fmt.Fprintln(&expectedBuf, "STOP:a,")
+	fmt.Fprintln(&expectedBuf, "returned:tx_not_writable")
+	fmt.Fprintln(&expectedBuf, "raised:boom")
+	fmt.Fprintln(&expectedBuf, "tx:b1,")
+	src := `
+local bolt = require("bolt")
+
+db.update(function(tx)
+  local b = tx.create_bucket("b1")
+  tx.create_bucket("b2")
+  for _, k in ipairs({"a", "b", "c", "d"}) do
+    b.put(k, k)
+  end
+end)
+
+db.view(function(tx)
+  local b = tx.bucket("b1")
+  local s = "false:"
+  b.for_each(function(k, v)
+    s = s .. k .. ","
+    return k ~= "b"
+  end)
+  fprintf("%s\n", s)
+
+  s = "STOP:"
+  b.for_each(function(k, v)
+    s = s .. k .. ","
+    return bolt.STOP
+  end)
+  fprintf("%s\n", s)
+
+  local ok, err = pcall(b.for_each, function(k, v)
+    local ok, err = pcall(tx.delete_bucket, "nope")
+    return err
+  end)
+  fprintf("returned:%s\n", err.code)
+
+  ok, err = pcall(b.for_each, function(k, v)
+    error("boom", 0)
+  end)
+  fprintf("raised:%s\n", err)
+
+  s = "tx:"
+  tx.for_each(function(name, b)
+    s = s .. name .. ","
+    return false
+  end)
+  fprintf("%s\n", s)
+end)
+`
+	if err := lua.DoString(l, src); err != nil {
+		t.Error(err)
+		return
+	}
+	if buf.String() != expectedBuf.String() {
+		t.Errorf("expected:\n%s\ngot:\n%s", expectedBuf.String(), buf.String())
+	}
+}
+
+func TestColonSyntax(t *testing.T) {
+	l, db, buf := setupLuaAndDB(t)
+	defer db.Close()
+
+	var expectedBuf bytes.Buffer
+	fmt.Fprintln(&expectedBuf, "path:true")
+	fmt.Fprintln(&expectedBuf, "cached:true")
+	fmt.Fprintln(&expectedBuf, "a:1")
+	fmt.Fprintln(&expectedBuf, "b:2")
+	fmt.Fprintln(&expectedBuf, "key_n:true")
+	fmt.Fprintln(&expectedBuf, "page_count:true")
+	fmt.Fprintln(&expectedBuf, "committed")
+	fmt.Fprintln(&expectedBuf, "tx_n:true")
+	src := `
+local bolt = require("bolt")
+
+fprintf("path:%t\n", db:path() == db.path())
+
+db:update(function(tx)
+  tx:on_commit(function() fprintf("committed\n") end)
+  local b = tx:create_bucket("b")
+  b:put("a", "1")
+  b.put("b", "2")
+  local c = b:cursor()
+  fprintf("cached:%t\n", c.next == c.next and c.next ~= b:cursor().next)
+  local k, v = c:first()
+  while k do
+    fprintf("%s:%s\n", k, v)
+    k, v = c.next()
+  end
+  local stats = b:stats()
+  stats:add(b.stats())
+  fprintf("key_n:%t\n", stats.key_n == 2 * b:stats().key_n)
+  local txStats = tx:stats()
+  fprintf("page_count:%t\n", txStats:sub(tx.stats()).page_count == 0)
+end)
+
+local stats = db:stats()
+fprintf("tx_n:%t\n", stats:sub(db.stats()).tx_n == 0)
+`
+	if err := lua.DoString(l, src); err != nil {
+		t.Error(err)
+		return
+	}
+	if buf.String() != expectedBuf.String() {
+		t.Errorf("expected:\n%s\ngot:\n%s", expectedBuf.String(), buf.String())
+	}
+}
+
+// benchKeyN is the number of keys walked by the cursor benchmarks.
+const benchKeyN = 1000000
+
+// setupBenchDB returns a Lua state with a db holding benchKeyN keys in
+// the bucket "keys".
+func setupBenchDB(b *testing.B) (*lua.State, *DB) {
+	l, db, _ := setupLuaAndDB(b)
+	if err := db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucket([]byte("keys"))
+		if err != nil {
+			return err
+		}
+		bucket.FillPercent = 1
+		for i := 0; i < benchKeyN; i++ {
+			if err := bucket.Put([]byte(fmt.Sprintf("k%.7d", i)), []byte("v")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		b.Fatal(err)
+	}
+	return l, db
+}
+
+func benchmarkCursorWalk(b *testing.B, src string) {
+	l, db := setupBenchDB(b)
+	defer db.Close()
+	if err := lua.LoadString(l, src); err != nil {
+		b.Fatal(err)
+	}
+	l.SetGlobal("walk")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l.Global("walk")
+		if err := l.ProtectedCall(0, 0, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCursorWalkDot(b *testing.B) {
+	benchmarkCursorWalk(b, `
+db.view(function(tx)
+  local c = tx.bucket("keys").cursor()
+  local k = c.first()
+  while k do
+    k = c.next()
+  end
+end)
+`)
+}
+
+func BenchmarkCursorWalkColon(b *testing.B) {
+	benchmarkCursorWalk(b, `
+db.view(function(tx)
+  local c = tx:bucket("keys"):cursor()
+  local k = c:first()
+  while k do
+    k = c:next()
+  end
+end)
+`)
+}
+
+func BenchmarkCursorWalkPairs(b *testing.B) {
+	benchmarkCursorWalk(b, `
+db.view(function(tx)
+  for k in tx:bucket("keys"):pairs() do
+  end
+end)
+`)
+}
+
+func TestClosedTx(t *testing.T) {
+	l, db, buf := setupLuaAndDB(t)
+	defer db.Close()
+
+	var expectedBuf bytes.Buffer
+	for _, s := range []string{"tx", "bucket", "cursor", "bucket.tx", "iterator", "tx.commit", "committed bucket", "managed commit"} {
+		fmt.Fprintf(&expectedBuf, "%s:false\n", s)
+	}
+	fmt.Fprintln(&expectedBuf, "tx_closed:Bucket")
+	src := `
+local bolt = require("bolt")
+
+local function try(name, f, ...)
+  local ok, err = pcall(f, ...)
+  fprintf("%s:%t\n", name, ok)
+  return err
+end
+
+local ktx, kb, kc, kiter
+db.update(function(tx)
+  ktx = tx
+  kb = tx.create_bucket("b")
+  kb.put("k", "v")
+  kc = kb.cursor()
+  kiter = kb:pairs()
+end)
+try("tx", ktx.bucket, "b")
+try("bucket", kb.get, "k")
+try("cursor", kc.first)
+try("bucket.tx", kb.tx)
+try("iterator", kiter)
+
+local tx = db.begin(true)
+local b = tx.bucket("b")
+tx.commit()
+try("tx.commit", tx.commit)
+local err = try("committed bucket", b.put, "k", "v2")
+
+db.update(function(tx)
+  try("managed commit", tx.commit)
+end)
+fprintf("%s:%s\n", err.code, err.op)
+`
+	if err := lua.DoString(l, src); err != nil {
+		t.Error(err)
+		return
+	}
+	if buf.String() != expectedBuf.String() {
+		t.Errorf("expected:\n%s\ngot:\n%s", expectedBuf.String(), buf.String())
+	}
+
+	// Values of a transaction pushed by the host, which closes it.
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := tx.CreateBucket([]byte("host"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	luabolt.PushBucket(l, b)
+	l.SetGlobal("kept")
+	luabolt.PushCursor(l, b.Cursor())
+	l.SetGlobal("kept_cursor")
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	src = `
+local ok, err = pcall(kept.get, "k")
+fprintf("%t:%s\n", ok, err.code)
+ok, err = pcall(kept_cursor.first)
+fprintf("%t:%s\n", ok, err.code)
+`
+	if err := lua.DoString(l, src); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "false:tx_closed\nfalse:tx_closed\n"; buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestNestedTx(t *testing.T) {
+	l, db, buf := setupLuaAndDB(t)
+	defer db.Close()
+
+	expected := `update in view:false:tx_nested
+begin in update:false:tx_nested
+batch in begin:false:tx_nested
+view in update:false:tx_nested
+read begin in update:false:tx_nested
+read begin in view:true
+begin after rollback:true
+`
+	src := `
+local bolt = require("bolt")
+
+local function try(name, f, ...)
+  local ok, err = pcall(f, ...)
+  if ok then
+    fprintf("%s:%t\n", name, ok)
+  else
+    fprintf("%s:%t:%s\n", name, ok, err.code)
+  end
+end
+
+db.view(function(tx)
+  try("update in view", db.update, function(tx) end)
+end)
+db.update(function(tx)
+  try("begin in update", db.begin, true)
+end)
+local rtx = db.begin(false)
+try("batch in begin", db.batch, function(tx) end)
+rtx.rollback()
+db.update(function(tx)
+  try("view in update", db.view, function(tx) end)
+  try("read begin in update", db.begin, false)
+end)
+db.view(function(tx)
+  try("read begin in view", function()
+    db.begin(false).rollback()
+  end)
+end)
+try("begin after rollback", function()
+  db.begin(true).rollback()
+end)
+db.view(function(tx)
+  db.update(function(tx) end)
+end)
+`
+	err := lua.DoString(l, src)
+	if !errors.Is(err, luabolt.ErrTxNested) {
+		t.Errorf("expected %v, got %v", luabolt.ErrTxNested, err)
+	}
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestCloseState(t *testing.T) {
+	l, db, _ := setupLuaAndDB(t)
+	defer db.Close()
+
+	path := tempfile()
+	defer os.Remove(path)
+	l.PushString(path)
+	l.SetGlobal("path")
+	src := `
+local bolt = require("bolt")
+local closed = bolt.open(path .. ".closed", 384)
+closed.close()
+os.remove(path .. ".closed")
+leaked = bolt.open(path, 384)
+leaked.begin(false)
+db.begin(false).rollback()
+local tx = db.begin(true)
+`
+	if err := lua.DoString(l, src); err != nil {
+		t.Fatal(err)
+	}
+	err := luabolt.CloseState(l)
+	var leak *luabolt.LeakError
+	if !errors.As(err, &leak) {
+		t.Fatalf("expected a leak error, got %v", err)
+	}
+	if len(leak.Txs) != 2 || !strings.HasSuffix(leak.Txs[1], ":9") {
+		t.Errorf("expected 2 leaked txs, got %q", leak.Txs)
+	}
+	if len(leak.DBs) != 1 || leak.DBs[0] != path {
+		t.Errorf("expected db %s to leak, got %q", path, leak.DBs)
+	}
+	// The leaked write tx is rolled back: this doesn't block.
+	if err := db.Update(func(tx *bolt.Tx) error { return nil }); err != nil {
+		t.Error(err)
+	}
+	if err := luabolt.CloseState(l); err != nil {
+		t.Errorf("expected no leak after CloseState, got %v", err)
+	}
+}
+
+func TestCommitReadTx(t *testing.T) {
+	l, db, buf := setupLuaAndDB(t)
+	defer db.Close()
+	src := `
+local tx = db.begin(false)
+local ok, err = pcall(tx.commit)
+fprintf("%t %s\n", ok, err.code)
+fprintf("%t\n", tx.rollback())
+leaked = db.begin(false)
+ok, err = pcall(leaked.commit)
+fprintf("%t %s\n", ok, err.code)
+`
+	if err := lua.DoString(l, src); err != nil {
+		t.Fatal(err)
+	}
+	expected := `false tx_not_writable
+true
+false tx_not_writable
+`
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+	err := luabolt.CloseState(l)
+	var leak *luabolt.LeakError
+	if !errors.As(err, &leak) || len(leak.Txs) != 1 {
+		t.Fatalf("expected a leaked tx, got %v", err)
+	}
+}
+
+func TestLeakedTxFinalizer(t *testing.T) {
+	l, db, _ := setupLuaAndDB(t)
+	// The db isn't closed if the tx isn't rolled back, since closing it
+	// would wait for the tx.
+
+	if err := lua.DoString(l, `db.begin(true)`); err != nil {
+		t.Fatal(err)
+	}
+	l = nil
+	done := make(chan error)
+	go func() {
+		done <- db.Update(func(tx *bolt.Tx) error { return nil })
+	}()
+	deadline := time.After(10 * time.Second)
+	for {
+		runtime.GC()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Error(err)
+			}
+			db.Close()
+			return
+		case <-deadline:
+			t.Fatal("the leaked tx wasn't rolled back")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestConcurrentBatch(t *testing.T) {
+	db := NewDB(t)
+	defer db.Close()
+	const n = 8
+	db.MaxBatchSize = n
+	db.MaxBatchDelay = time.Second
+
+	pool := luabolt.NewPool(n, func() (*lua.State, error) {
+		l := lua.NewState()
+		lua.OpenLibraries(l)
+		luabolt.Open(l)
+		luabolt.PushDB(l, db.DB, "db")
+		return l, nil
+	})
+	src := `
+calls = 0
+local ok, err = db.batch(function(tx)
+  calls = calls + 1
+  local b = tx.create_bucket_if_not_exists("b")
+  b.put(tostring(i), "v")
+  if i == 3 then
+    return nil, "fail " .. i
+  end
+end)
+return calls, ok, err
+`
+	type result struct {
+		i      int
+		calls  int
+		ok     bool
+		errMsg string
+		err    error
+	}
+	results := make(chan result, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			r := result{i: i}
+			defer func() { results <- r }()
+			l, err := pool.Get(context.Background())
+			if err != nil {
+				r.err = err
+				return
+			}
+			defer pool.Put(l)
+			l.PushInteger(i)
+			l.SetGlobal("i")
+			if r.err = lua.LoadString(l, src); r.err != nil {
+				return
+			}
+			if r.err = l.ProtectedCall(0, 3, 0); r.err != nil {
+				return
+			}
+			r.calls, _ = l.ToInteger(-3)
+			r.ok = l.ToBoolean(-2)
+			r.errMsg, _ = l.ToString(-1)
+		}(i)
+	}
+	for k := 0; k < n; k++ {
+		r := <-results
+		if r.err != nil {
+			t.Errorf("%d: %v", r.i, r.err)
+			continue
+		}
+		switch {
+		case r.i == 3 && (r.ok || r.errMsg != "fail 3" || r.calls != 1):
+			t.Errorf("%d: expected a single failed call, got %d calls, %t, %q", r.i, r.calls, r.ok, r.errMsg)
+		case r.i != 3 && (!r.ok || r.calls < 1 || r.calls > 2):
+			t.Errorf("%d: expected success, got %d calls, %t, %q", r.i, r.calls, r.ok, r.errMsg)
+		}
+	}
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("b"))
+		for i := 0; i < n; i++ {
+			v := b.Get([]byte(fmt.Sprint(i)))
+			if (i == 3) != (v == nil) {
+				t.Errorf("%d: unexpected value %q", i, v)
+			}
+		}
+		return nil
+	})
+}
+
+func TestEngine(t *testing.T) {
+	db := NewDB(t)
+	defer os.Remove(db.Path())
+	e := luabolt.NewEngine(db.DB, 2)
+
+	src := `
+local key, n = ...
+local total
+db.update(function(tx)
+  local b = tx.create_bucket_if_not_exists("counters")
+  total = (tonumber(b.get(key)) or 0) + n
+  b.put(key, tostring(total))
+end)
+local seen = x
+x = total
+return total, seen
+`
+	const n = 10
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			results, err := e.Run(context.Background(), src, "k", 2)
+			if err == nil && (len(results) != 2 || results[1] != nil) {
+				err = fmt.Errorf("unexpected results %v", results)
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	results, err := e.Run(context.Background(), src, []byte("k"), 1.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0] != 2*n+1.5 {
+		t.Errorf("expected total %v, got %v", 2*n+1.5, results[0])
+	}
+
+	_, err = e.Run(context.Background(), `db.begin(false)`)
+	var leak *luabolt.LeakError
+	if !errors.As(err, &leak) {
+		t.Errorf("expected a leak error, got %v", err)
+	}
+	if _, err := e.Run(context.Background(), `error("boom")`); err == nil {
+		t.Error("expected an error")
+	}
+
+	_, err = e.Run(context.Background(), `db.close()`)
+	if !errors.Is(err, luabolt.ErrPermission) {
+		t.Errorf("expected %v, got %v", luabolt.ErrPermission, err)
+	}
+	if _, err := e.Run(context.Background(), src, "k", 1); err != nil {
+		t.Errorf("expected a run after db.close(), got %v", err)
+	}
+
+	stats := e.Stats()
+	if stats.Runs != n+5 || stats.Failures != 3 {
+		t.Errorf("expected %d runs and 3 failures, got %+v", n+5, stats)
+	}
+	if stats.Pool.Size != 2 || stats.Pool.Open > 2 || stats.Pool.InUse != 0 {
+		t.Errorf("unexpected pool stats %+v", stats.Pool)
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Run(context.Background(), `return 1`); err != luabolt.ErrEngineClosed {
+		t.Errorf("expected %v, got %v", luabolt.ErrEngineClosed, err)
+	}
+}
+
+func TestEngineWith(t *testing.T) {
+	db := NewDB(t)
+	defer os.Remove(db.Path())
+	e := luabolt.NewEngineWith(db.DB, 1, func() (*lua.State, error) {
+		return luabolt.NewSandboxedState(luabolt.Profile{})
+	})
+	defer e.Close()
+
+	results, err := e.Run(context.Background(), `
+db.update(function(tx) tx.create_bucket("b") end)
+return os == nil, io == nil, (pcall(bolt.open, "x.db", 384))
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(results) != "[true true false]" {
+		t.Errorf("expected a sandboxed state, got %v", results)
+	}
+	// The changes made through _G are seen by the following runs.
+	if _, err := e.Run(context.Background(), `_G.x = 1`); err != nil {
+		t.Fatal(err)
+	}
+	results, err = e.Run(context.Background(), `return x`)
+	if err != nil || len(results) != 1 || results[0] != 1.0 {
+		t.Errorf("expected x to be 1, got %v, %v", results, err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	db := NewDB(t)
+	defer os.Remove(db.Path())
+	e := luabolt.NewEngine(db.DB, 1)
+	defer e.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	tests := []struct {
+		ctx    context.Context
+		limits luabolt.Limits
+		src    string
+		err    error
+	}{
+		{context.Background(), luabolt.Limits{Instructions: 10000}, `
+db.update(function(tx)
+  tx.create_bucket("b")
+  while true do end
+end)`, luabolt.ErrInstructionLimit},
+		{ctx, luabolt.Limits{}, `
+db.update(function(tx)
+  tx.create_bucket("b")
+  while true do
+    pcall(function() while true do end end)
+  end
+end)`, context.Canceled},
+		{context.Background(), luabolt.Limits{Duration: 50 * time.Millisecond}, `
+local tx = db.begin(true)
+tx.create_bucket("b")
+while true do
+  pcall(tx.bucket, "b")
+end`, context.DeadlineExceeded},
+	}
+	for i, test := range tests {
+		_, err := e.RunWithLimits(test.ctx, test.limits, test.src)
+		var berr *luabolt.Error
+		if !errors.Is(err, test.err) || !errors.As(err, &berr) || berr.Code != luabolt.ErrCodeAborted {
+			t.Errorf("%d: expected an aborted error for %v, got %v", i, test.err, err)
+		}
+		if err := db.View(func(tx *bolt.Tx) error {
+			if tx.Bucket([]byte("b")) != nil {
+				return errors.New("bucket b wasn't rolled back")
+			}
+			return nil
+		}); err != nil {
+			t.Errorf("%d: %v", i, err)
+		}
+	}
+	if _, err := e.RunWithLimits(context.Background(), luabolt.Limits{Instructions: 10000}, `
+db.update(function(tx) tx.create_bucket("b") end)`); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExec(t *testing.T) {
+	l, db, _ := setupLuaAndDB(t)
+	defer db.Close()
+
+	src := `
+local db, name, opts, list, raw = ...
+db.update(function(tx)
+  local b = tx.create_bucket(name)
+  for i, v in ipairs(list) do
+    b.put(tostring(i), v)
+  end
+  b.put("raw", raw)
+end)
+return opts.n + 1, {list[2], raw, {a = true}, [3] = false}, {x = opts.tags[1]}, nil
+`
+	results, err := luabolt.Exec(l, db.DB, src, "b", map[string]interface{}{"n": 41, "tags": []string{"t"}}, []string{"v1", "v2"}, []byte{0xff, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []interface{}{
+		float64(42),
+		[]interface{}{"v2", []byte{0xff, 0}, map[string]interface{}{"a": true}},
+		map[string]interface{}{"x": "t"},
+		nil,
+	}
+	if fmt.Sprint(results[:1]) != fmt.Sprint(expected[:1]) || fmt.Sprint(results[2:]) != fmt.Sprint(expected[2:]) {
+		t.Errorf("expected %v, got %v", expected, results)
+	}
+	if s, ok := results[1].([]interface{}); !ok || len(s) != 3 || s[0] != "v2" || !bytes.Equal(s[1].([]byte), []byte{0xff, 0}) {
+		t.Errorf("expected a sequence, got %#v", results[1])
+	}
+
+	conv := luabolt.Conversion{Tables: luabolt.TablesMap, Strings: luabolt.StringsString}
+	tx, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	results, err = conv.ExecTx(l, tx, `
+kept = ...
+local b = kept.bucket("b")
+return {b.get("1"), b.get("raw")}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, ok := results[0].(map[interface{}]interface{})
+	if !ok || m[float64(1)] != "v1" || m[float64(2)] != "\xff\x00" {
+		t.Errorf("unexpected result %#v", results[0])
+	}
+	if _, err := luabolt.Exec(l, db.DB, `return kept.bucket("b")`); err == nil || !strings.Contains(err.Error(), "tx closed") {
+		t.Errorf("expected a tx closed error, got %v", err)
+	}
+	if _, err := luabolt.Exec(l, db.DB, `return print`); err == nil {
+		t.Error("expected a conversion error")
+	}
+}
+
+func TestPushCheck(t *testing.T) {
+	l, db, buf := setupLuaAndDB(t)
+	defer db.Close()
+
+	// count returns the number of keys of a bucket, given a tx and its
+	// name, or given a bucket.
+	l.Register("count", func(l *lua.State) int {
+		var b *bolt.Bucket
+		if lua.TestUserData(l, 1, luabolt.TypeTx) != nil {
+			b = luabolt.CheckTx(l, 1).Bucket([]byte(lua.CheckString(l, 2)))
+		} else {
+			b = luabolt.CheckBucket(l, 1)
+		}
+		n := 0
+		b.ForEach(func(k, v []byte) error {
+			n++
+			return nil
+		})
+		l.PushInteger(n)
+		return 1
+	})
+	l.Register("path", func(l *lua.State) int {
+		l.PushString(luabolt.CheckDB(l, 1).Path())
+		return 1
+	})
+	l.Register("first", func(l *lua.State) int {
+		k, _ := luabolt.CheckCursor(l, 1).First()
+		l.PushString(string(k))
+		return 1
+	})
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := tx.CreateBucket([]byte("b"))
+	b.Put([]byte("k1"), []byte("v1"))
+	b.Put([]byte("k2"), []byte("v2"))
+
+	if err := lua.LoadString(l, `
+local tx, b, c, stats = ...
+fprintf("%v %v %s %v %t\n", count(tx, "b"), count(b), first(c), stats.tx_n, path(db) == db.path())
+tx.commit()
+return pcall(count, b)
+`); err != nil {
+		t.Fatal(err)
+	}
+	luabolt.PushTxValue(l, tx)
+	luabolt.PushBucket(l, b)
+	luabolt.PushCursor(l, b.Cursor())
+	luabolt.PushStats(l, db.Stats())
+	if err := l.ProtectedCall(4, 2, 0); err != nil {
+		t.Fatal(err)
+	}
+	if ok := l.ToBoolean(-2); ok {
+		t.Error("expected the bucket to be closed with its tx")
+	}
+	if expected := "2 2 k1 0 true\n"; buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+}
+
+func TestRegisterMethod(t *testing.T) {
+	luabolt.RegisterMethod(luabolt.TypeBucket, "get_upper", func(l *lua.State) int {
+		v := luabolt.CheckBucket(l, 1).Get([]byte(lua.CheckString(l, 2)))
+		l.PushString(strings.ToUpper(string(v)))
+		return 1
+	})
+	// Override the root method with a field.
+	luabolt.RegisterGetter(luabolt.TypeBucket, "root", func(l *lua.State) int {
+		l.PushString("overridden")
+		return 1
+	})
+	luabolt.RegisterGetter(luabolt.TypeTx, "label", func(l *lua.State) int {
+		l.PushInteger(luabolt.CheckTx(l, 1).ID())
+		return 1
+	})
+	var label string
+	luabolt.RegisterSetter(luabolt.TypeTx, "label", func(l *lua.State) int {
+		luabolt.CheckTx(l, 1)
+		label = lua.CheckString(l, 3)
+		return 0
+	})
+	unregister := func() {
+		luabolt.Unregister(luabolt.TypeBucket, "get_upper")
+		luabolt.Unregister(luabolt.TypeBucket, "root")
+		luabolt.Unregister(luabolt.TypeTx, "label")
+	}
+	defer unregister()
+
+	l, db, buf := setupLuaAndDB(t)
+	defer db.Close()
+	src := `
+db.update(function(tx)
+  local b = tx.create_bucket("b")
+  b.put("k", "value")
+  tx.label = "audit"
+  fprintf("%s %s %s %v\n", b.get_upper("k"), b:get_upper("k"), b.root, tx.label)
+end)
+`
+	if err := lua.DoString(l, src); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "VALUE VALUE overridden 2\n"; buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+	if label != "audit" {
+		t.Errorf("expected label to be set, got %q", label)
+	}
+
+	// The built-in types are restored.
+	unregister()
+	l, db2, buf := setupLuaAndDB(t)
+	defer db2.Close()
+	src = `
+db.update(function(tx)
+  local b = tx.create_bucket("b")
+  local function field(v, k) return v[k] end
+  fprintf("%t %s %t\n", (pcall(field, b, "get_upper")), type(b.root), (pcall(field, tx, "label")))
+end)
+`
+	if err := lua.DoString(l, src); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "false function false\n"; buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+}
+
+func TestOpenWith(t *testing.T) {
+	db := NewDB(t)
+	defer db.Close()
+	l := lua.NewState()
+	lua.OpenLibraries(l)
+	var buf bytes.Buffer
+	l.Register("fprintf", func(l *lua.State) int {
+		return fprintf(l, &buf)
+	})
+	config := luabolt.Config{
+		Name:     "kv",
+		Global:   true,
+		Safe:     true,
+		Disabled: luabolt.CapOpen | luabolt.CapWrite | luabolt.CapPageInfo,
+		Options:  &bolt.Options{Timeout: 2 * time.Second},
+	}
+	luabolt.OpenWith(l, config)
+	l.Global("kv")
+	l.SetGlobal("first")
+	luabolt.OpenWith(l, config)
+	luabolt.OpenWith(l, luabolt.Config{Name: "kv", Safe: true, Disabled: config.Disabled, Options: config.Options})
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected OpenWith to panic with another config")
+			}
+		}()
+		luabolt.OpenWith(l, luabolt.Config{Name: "kv", Safe: true})
+	}()
+	luabolt.PushDB(l, db.DB, "db")
+
+	src := `
+local mod = kv
+fprintf("%t %s %s\n", require("kv") == mod and mod == first, mod.options().timeout, mod.options{read_only = true}.timeout)
+local function try(name, ...)
+  local ok, err = ...
+  if ok then
+    fprintf("%s:%t\n", name, ok)
+  else
+    fprintf("%s:%s\n", name, err.code)
+  end
+end
+try("open", kv.open("x.db", 384))
+try("update", db.update(function(tx) end))
+try("begin", db.begin(true))
+db.view(function(tx)
+  try("page_info", tx.page_info(0))
+  try("check", tx.check())
+end)
+`
+	if err := lua.DoString(l, src); err != nil {
+		t.Fatal(err)
+	}
+	expected := `true 2s 2s
+open:permission
+update:permission
+begin:permission
+page_info:permission
+check:true
+`
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestPushDBReadOnly(t *testing.T) {
+	l, db, buf := setupLuaAndDB(t)
+	defer db.Close()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("b"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("k"), []byte("v"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	luabolt.PushDBReadOnly(l, db.DB, "rodb")
+	path := tempfile()
+	defer os.Remove(path)
+	l.PushString(path)
+	l.SetGlobal("path")
+
+	src := `
+local function try(name, f, ...)
+  local ok, err = pcall(f, ...)
+  if ok then
+    fprintf("%s:%t\n", name, ok)
+  else
+    fprintf("%s:%s\n", name, err.code)
+  end
+end
+rodb.view(function(tx)
+  fprintf("%s\n", tx.bucket("b").get("k"))
+  try("tx.db.update", function() tx.db().update(function() end) end)
+  try("tx.db.path", function() assert(tx.db().path() == rodb.path()) end)
+  try("tx.copy_file", tx.copy_file, path, 384)
+end)
+local tx = rodb.begin(false)
+tx.rollback()
+try("stats", rodb.stats)
+try("info", rodb.info)
+try("begin", rodb.begin, true)
+try("update", function() rodb.update(function() end) end)
+try("batch", function() rodb.batch(function() end) end)
+try("close", function() rodb.close() end)
+try("sync", function() rodb.sync() end)
+try("get no_sync", function() return rodb.no_sync end)
+try("set no_sync", function() rodb.no_sync = true end)
+`
+	if err := lua.DoString(l, src); err != nil {
+		t.Fatal(err)
+	}
+	expected := `v
+tx.db.update:permission
+tx.db.path:true
+tx.copy_file:permission
+stats:true
+info:true
+begin:permission
+update:permission
+batch:permission
+close:permission
+sync:permission
+get no_sync:permission
+set no_sync:permission
+`
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected %s not to be created, got %v", path, err)
+	}
+}
+
+func TestOpenSandbox(t *testing.T) {
+	root, err := ioutil.TempDir("", "luabolt-root-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	outside, err := ioutil.TempDir("", "luabolt-outside-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	os.Mkdir(root+"/sub", 0700)
+	os.Symlink(outside, root+"/out")
+	os.Symlink(outside+"/x.db", root+"/dangling.db")
+	os.Symlink("sub", root+"/in")
+
+	l := lua.NewState()
+	lua.OpenLibraries(l)
+	var buf bytes.Buffer
+	l.Register("fprintf", func(l *lua.State) int {
+		return fprintf(l, &buf)
+	})
+	luabolt.OpenWith(l, luabolt.Config{
+		Safe:    true,
+		Root:    root,
+		Modes:   []os.FileMode{0600},
+		MaxOpen: 1,
+	})
+	src := `
+local bolt = require("bolt")
+local function try(name, db, err)
+  if db then
+    fprintf("%s:ok\n", name)
+    return db
+  end
+  fprintf("%s:%s\n", name, err.code)
+end
+try("absolute", bolt.open("/tmp/luabolt-absolute.db", 384))
+try("parent", bolt.open("sub/../../x.db", 384))
+try("symlink", bolt.open("out/x.db", 384))
+try("dangling", bolt.open("dangling.db", 384))
+try("mode", bolt.open("sub/x.db", 420))
+local db = try("in", bolt.open("in/x.db", 384))
+try("max", bolt.open("sub/y.db", 384))
+db.close()
+db = try("reopen", bolt.open("sub/y.db", 384))
+db.view(function(tx)
+  try("copy absolute", tx.copy_file("/tmp/luabolt-copy.db", 384))
+  try("copy symlink", tx.copy_file("out/copy.db", 384))
+  try("copy mode", tx.copy_file("sub/copy.db", 420))
+  try("copy", tx.copy_file("sub/copy.db", 384))
+end)
+db.close()
+`
+	if err := lua.DoString(l, src); err != nil {
+		t.Fatal(err)
+	}
+	expected := `absolute:permission
+parent:permission
+symlink:permission
+dangling:permission
+mode:permission
+in:ok
+max:permission
+reopen:ok
+copy absolute:permission
+copy symlink:permission
+copy mode:permission
+copy:ok
+`
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+	for _, path := range []string{"/sub/x.db", "/sub/copy.db"} {
+		if _, err := os.Stat(root + path); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := os.Stat("/tmp/luabolt-copy.db"); !os.IsNotExist(err) {
+		t.Errorf("expected no copy outside of the root, got %v", err)
+	}
+	if files, _ := ioutil.ReadDir(outside); len(files) != 0 {
+		t.Errorf("expected no file outside of the root, got %d", len(files))
+	}
+}
+
+func TestSharedDB(t *testing.T) {
+	l, db, buf := setupLuaAndDB(t)
+	defer db.Close()
+	if err := luabolt.RegisterDB("main", db.DB); err != nil {
+		t.Fatal(err)
+	}
+	defer luabolt.UnregisterDB("main")
+	if err := luabolt.RegisterDB("main", db.DB); err == nil {
+		t.Error("expected an error registering main twice")
+	}
+
+	path := tempfile()
+	defer os.Remove(path)
+	l.PushString(path)
+	l.SetGlobal("path")
+	other := lua.NewState()
+	lua.OpenLibraries(other)
+	luabolt.Open(other)
+	other.PushString(path)
+	other.SetGlobal("path")
+	if err := lua.DoString(other, `
+local bolt = require("bolt")
+db = bolt.open(path, 384, {timeout = "100ms"})
+assert(db.update(function(tx) return tx.create_bucket("b").put("k", "v") end))
+`); err != nil {
+		t.Fatal(err)
+	}
+
+	src := `
+local bolt = require("bolt")
+local opts = {timeout = "100ms"}
+local a = assert(bolt.open(path, 384, opts))
+local b = assert(bolt.open(path, 384, opts))
+fprintf("%t\n", a.close())
+b.view(function(tx) fprintf("%s\n", tx.bucket("b").get("k")) end)
+fprintf("%t\n", b.close())
+local ok, err = pcall(b.close)
+fprintf("%t %s\n", ok, err.code)
+ok, err = pcall(bolt.open, path, 384, {timeout = "100ms", read_only = true})
+fprintf("%t %s\n", ok, err.code)
+ok, err = pcall(bolt.open, path, 420, opts)
+fprintf("%t %s\n", ok, err.code)
+
+local host = assert(bolt.open(db.path(), 384, opts))
+fprintf("%t\n", host.close())
+local named = assert(bolt.open_named("main"))
+named.update(function(tx) return tx.create_bucket("main") end)
+fprintf("%t\n", named.close())
+ok, err = pcall(bolt.open_named, "missing")
+fprintf("%t %s\n", ok, err.code)
+shared = assert(bolt.open(path, 384, opts))
+`
+	if err := lua.DoString(l, src); err != nil {
+		t.Fatal(err)
+	}
+	expected := `true
+v
+true
+false permission
+false database_open
+false database_open
+true
+true
+false unknown_db
+`
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+
+	// The host DB is still open, and the DB of other stays open until
+	// both states release it.
+	if err := db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("main")) == nil {
+			return errors.New("expected bucket main")
+		}
+		return nil
+	}); err != nil {
+		t.Error(err)
+	}
+	var leak *luabolt.LeakError
+	if err := luabolt.CloseState(l); !errors.As(err, &leak) || len(leak.DBs) != 1 {
+		t.Errorf("expected a leaked db, got %v", err)
+	}
+	if err := lua.DoString(other, `assert(db.view(function(tx) assert(tx.bucket("b")) end))`); err != nil {
+		t.Error(err)
+	}
+	if err := luabolt.CloseState(other); !errors.As(err, &leak) {
+		t.Errorf("expected a leaked db, got %v", err)
+	}
+	shared, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("expected the db to be closed: %v", err)
+	}
+	shared.Close()
+}
+
+func TestUnregisterDB(t *testing.T) {
+	l, db, buf := setupLuaAndDB(t)
+	defer db.Close()
+	if err := luabolt.RegisterDB("unregistered", db.DB); err != nil {
+		t.Fatal(err)
+	}
+	if err := lua.DoString(l, `named = assert(require("bolt").open_named("unregistered"))`); err != nil {
+		t.Fatal(err)
+	}
+	luabolt.UnregisterDB("unregistered")
+	if err := lua.DoString(l, `fprintf("%t\n", named.close())`); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "true\n" {
+		t.Errorf("expected true, got %q", buf.String())
+	}
+	// The script didn't close the DB of the host, and no longer refers to
+	// it in the registry.
+	if err := db.View(func(tx *bolt.Tx) error { return nil }); err != nil {
+		t.Error(err)
+	}
+	if err := luabolt.RegisterDB("unregistered", db.DB); err != nil {
+		t.Fatal(err)
+	}
+	luabolt.UnregisterDB("unregistered")
+}
+
+func TestOpenTemp(t *testing.T) {
+	l, db, buf := setupLuaAndDB(t)
+	defer db.Close()
+	src := `
+local bolt = require("bolt")
+local tmp = bolt.open_temp()
+path = tmp.path()
+fprintf("%t\n", tmp.update(function(tx) return tx.create_bucket("b").put("k", "v") end))
+tmp.view(function(tx) fprintf("%s\n", tx.bucket("b").get("k")) end)
+fprintf("%t\n", tmp.close())
+local f = io.open(path)
+fprintf("%t\n", f == nil)
+leaked = bolt.open_temp({no_grow_sync = true}).path()
+`
+	if err := lua.DoString(l, src); err != nil {
+		t.Fatal(err)
+	}
+	expected := `true
+v
+true
+true
+`
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+	l.Global("leaked")
+	leaked, _ := l.ToString(-1)
+	l.Pop(1)
+	if _, err := os.Stat(leaked); err != nil {
+		t.Fatal(err)
+	}
+	if err := luabolt.CloseState(l); err == nil {
+		t.Error("expected a leak error")
+	}
+	for _, path := range []string{leaked, filepath.Dir(leaked)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed, got %v", path, err)
+		}
+	}
+}
+
+func TestNewSandboxedState(t *testing.T) {
+	root, err := ioutil.TempDir("", "luabolt-root-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if _, err := luabolt.NewSandboxedState(luabolt.Profile{IO: luabolt.IORead}); err == nil {
+		t.Error("expected an error for io without a root")
+	}
+
+	outside, err := ioutil.TempDir("", "luabolt-outside-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	db := NewDB(t)
+	defer db.Close()
+
+	run := func(profile luabolt.Profile, src string) string {
+		l, err := luabolt.NewSandboxedState(profile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer luabolt.CloseState(l)
+		luabolt.PushDB(l, db.DB, "hostdb")
+		l.PushString(outside)
+		l.SetGlobal("outside")
+		var buf bytes.Buffer
+		l.Register("fprintf", func(l *lua.State) int {
+			return fprintf(l, &buf)
+		})
+		if err := lua.DoString(l, src); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	got := run(luabolt.Profile{}, `
+for _, name in ipairs({"os", "io", "package", "debug", "dofile", "loadfile", "load"}) do
+  fprintf("%s:%s\n", name, type(_G[name]))
+end
+fprintf("%t %s %.0f %s\n", require("bolt") == bolt, string.upper("s"), math.floor(1.5), table.concat({"a", "b"}))
+fprintf("%t\n", (pcall(require, "os")))
+`)
+	expected := `os:nil
+io:nil
+package:nil
+debug:nil
+dofile:nil
+loadfile:nil
+load:nil
+true S 1 ab
+false
+`
+	if got != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+
+	escape := `
+local function code(ok, err)
+  return ok and "ok" or err.code
+end
+fprintf("open:%s\n", code(pcall(bolt.open, outside .. "/open.db", 384)))
+hostdb.view(function(tx)
+  fprintf("copy_file:%s\n", code(pcall(tx.copy_file, outside .. "/copy.db", 384)))
+end)
+`
+	expected = `open:permission
+copy_file:permission
+`
+	for _, profile := range []luabolt.Profile{{}, {Config: luabolt.Config{Root: root}}} {
+		if got := run(profile, escape); got != expected {
+			t.Errorf("root %q: expected:\n%s\ngot:\n%s", profile.Config.Root, expected, got)
+		}
+	}
+	if names, err := ioutil.ReadDir(outside); err != nil || len(names) > 0 {
+		t.Errorf("expected no file outside of the root, got %v, %v", names, err)
+	}
+
+	// Opening the bolt module again doesn't lift the sandbox.
+	l, err := luabolt.NewSandboxedState(luabolt.Profile{Config: luabolt.Config{Root: root}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected Open to panic on a sandboxed state")
+			}
+		}()
+		luabolt.Open(l)
+	}()
+	l.PushString(root)
+	l.SetGlobal("root")
+	if err := lua.DoString(l, `
+local ok, err = pcall(bolt.open, root .. "/../escape.db", 384)
+assert(not ok and err.code == "permission", "expected a permission error")
+`); err != nil {
+		t.Error(err)
+	}
+	luabolt.CloseState(l)
+
+	profile := luabolt.Profile{Config: luabolt.Config{Root: root}, IO: luabolt.IOReadWrite}
+	got = run(profile, `
+local db = assert(bolt.open("x.db", 384))
+db.close()
+local f = assert(io.open("notes.txt", "w"))
+f:write("hello")
+f:close()
+f = assert(io.open("notes.txt"))
+fprintf("%.0f %s\n", f:seek("end"), io.type(f))
+f:close()
+fprintf("%s %t %t\n", io.type(f), io.open("../notes.txt") == nil, io.open("/etc/passwd") == nil)
+fprintf("%t\n", require("io") == io)
+`)
+	expected = `5 file
+closed file true true
+true
+`
+	if got != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+
+	if b, err := ioutil.ReadFile(filepath.Join(root, "notes.txt")); err != nil || string(b) != "hello" {
+		t.Errorf("expected notes.txt to be written, got %q, %v", b, err)
+	}
+
+	profile.IO = luabolt.IORead
+	got = run(profile, `
+local f, err = io.open("notes.txt", "a")
+fprintf("%t %s\n", f == nil, err)
+f = assert(io.open("notes.txt", "r"))
+fprintf("%.0f\n", f:seek("end"))
+f:close()
+`)
+	expected = `true notes.txt: permission denied: mode "a"
+5
+`
+	if got != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	l, db, buf := setupLuaAndDB(t)
+	defer db.Close()
+	src := `
+local function equal(a, b)
+  if type(a) ~= type(b) then return false end
+  if type(a) ~= "table" then return a == b end
+  for k, v in pairs(a) do
+    if not equal(v, b[k]) then return false end
+  end
+  for k in pairs(b) do
+    if a[k] == nil then return false end
+  end
+  return true
+end
+local value = {
+  name = "luabolt", ok = true, off = false, n = -12.5, big = 2^40, neg = -2^33,
+  bin = "\0\1\255\254", list = {1, "two", {three = 3}}, empty = {},
+  long = string.rep("x", 300),
+}
+db.update(function(tx)
+  local b = tx.create_bucket("values")
+  for _, codec in ipairs({"json", "msgpack"}) do
+    b.put_value(codec, value, codec)
+    fprintf("%s %t\n", codec, equal(value, b.get_value(codec, codec)))
+  end
+  fprintf("%t\n", equal({[1] = "a", [3] = "c", x = true}, (function()
+    b.put_value("mixed", {[1] = "a", [3] = "c", x = true}, "msgpack")
+    return b.get_value("mixed", "msgpack")
+  end)()))
+  fprintf("%s %s\n", b.codec, tostring(b.get_value("missing")))
+  b.put_value("default", {1, 2})
+  fprintf("%s\n", b.get("default"))
+
+  b.codec = "msgpack"
+  b.put_value("default", {1, 2})
+  fprintf("%.0f\n", #b.get("default"))
+  local child = b.create_bucket("child")
+  fprintf("%s\n", child.codec)
+  b.codec = nil
+  fprintf("%s\n", child.codec)
+  b.codec = "msgpack"
+
+  local ok, err = pcall(b.put_value, "k", {[1] = "a", [3] = "c"}, "json")
+  fprintf("%t %s\n", ok, err.code)
+  ok, err = pcall(b.put_value, "k", print)
+  fprintf("%t %s\n", ok, err.code)
+  b.put("bad", "\193")
+  ok, err = pcall(b.get_value, "bad")
+  fprintf("%t %s\n", ok, err.code)
+  ok, err = pcall(b.get_value, "k", "xml")
+  fprintf("%t %s\n", ok, err)
+end)
+`
+	if err := lua.DoString(l, src); err != nil {
+		t.Fatal(err)
+	}
+	expected := `json true
+msgpack true
+true
+json nil
+[1,2]
+3
+msgpack
+json
+false unknown
+false unknown
+false unknown
+false bolt: unknown codec xml
+`
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestBucketCodec(t *testing.T) {
+	l, db, buf := setupLuaAndDB(t)
+	defer db.Close()
+	luabolt.PushDBReadOnly(l, db.DB, "rodb")
+	src := `
+db.update(function(tx)
+  local b = tx.create_bucket("b")
+  b.codec = "msgpack"
+  b.put_value("k", {1, 2})
+  b.create_bucket("child").put_value("k", {3})
+  tx.create_bucket("other").put_value("k", {4})
+end)
+db.view(function(tx)
+  local b = tx.bucket("b")
+  fprintf("%s %.0f\n", b.codec, b.get_value("k")[2])
+  local child = b.bucket("child")
+  fprintf("%s %.0f\n", child.codec, child.get_value("k")[1])
+  fprintf("%s\n", tx.cursor().bucket().bucket("b").codec)
+  fprintf("%s %s\n", tx.bucket("other").codec, tx.bucket("other").get("k"))
+  local ok, err = pcall(function() tx.bucket("other").codec = "msgpack" end)
+  fprintf("%t %s\n", ok, err.code)
+end)
+rodb.view(function(tx)
+  local ok, err = pcall(function() tx.bucket("other").codec = "msgpack" end)
+  fprintf("%t %s\n", ok, err.code)
+end)
+
+local tx = db.begin(true)
+tx.bucket("other").codec = "msgpack"
+fprintf("%s\n", tx.bucket("other").codec)
+tx.rollback()
+db.update(function(tx)
+  fprintf("%s\n", tx.bucket("other").codec)
+  tx.delete_bucket("b")
+  fprintf("%s\n", tx.create_bucket("b").create_bucket("child").codec)
+end)
+db.view(function(tx) fprintf("%s\n", tx.bucket("b").bucket("child").codec) end)
+`
+	if err := lua.DoString(l, src); err != nil {
+		t.Fatal(err)
+	}
+	expected := `msgpack 2
+msgpack 3
+msgpack
+json [4]
+false tx_not_writable
+false permission
+msgpack
+json
+json
+json
+`
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+
+	// The codecs are kept by the state, not by the database.
+	other, otherDB, otherBuf := setupLuaAndDB(t)
+	defer otherDB.Close()
+	luabolt.PushDB(other, db.DB, "db")
+	if err := lua.DoString(other, `
+db.update(function(tx)
+  tx.create_bucket("c").codec = "msgpack"
+end)
+db.view(function(tx) fprintf("%s\n", tx.bucket("c").codec) end)
+`); err != nil {
+		t.Fatal(err)
+	}
+	if err := lua.DoString(l, `db.view(function(tx) fprintf("%s\n", tx.bucket("c").codec) end)`); err != nil {
+		t.Fatal(err)
+	}
+	if otherBuf.String() != "msgpack\n" || !strings.HasSuffix(buf.String(), "\njson\n") {
+		t.Errorf("expected the codec in its state only, got %q and %q", otherBuf.String(), buf.String())
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		luabolt.PushBucket(l, tx.Bucket([]byte("other")))
+		l.SetGlobal("hostb")
+		return lua.DoString(l, `hostb.codec = "msgpack"; fprintf("%s\n", hostb.codec)`)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := lua.DoString(l, `db.view(function(tx) fprintf("%s\n", tx.bucket("other").codec) end)`); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(buf.String(), "\nmsgpack\njson\n") {
+		t.Errorf("expected the codec of a host bucket in its value only, got %q", buf.String())
+	}
+}
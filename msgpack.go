@@ -0,0 +1,291 @@
+package luabolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// errMsgpackShort is the error of MessagePack data ending within a value.
+var errMsgpackShort = errors.New("luabolt: truncated MessagePack data")
+
+// msgpackCodec encodes values as MessagePack.
+//
+// Numbers with an integer value are encoded as integers, and others as
+// float 64. Strings are encoded as str, and binary strings as bin. The keys
+// of tables are encoded in the order of their encoding, so that equal
+// tables have the same encoding.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Encode(v interface{}) ([]byte, error) {
+	return appendMsgpack(nil, v)
+}
+
+func (msgpackCodec) Decode(data []byte) (interface{}, error) {
+	d := msgpackDecoder{data: data}
+	v, err := d.decode(0)
+	if err != nil {
+		return nil, err
+	}
+	if len(d.data) > 0 {
+		return nil, errors.New("luabolt: extra data after MessagePack value")
+	}
+	return v, nil
+}
+
+func appendMsgpack(b []byte, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(b, 0xc0), nil
+	case bool:
+		if v {
+			return append(b, 0xc3), nil
+		}
+		return append(b, 0xc2), nil
+	case float64:
+		return appendMsgpackNumber(b, v), nil
+	case string:
+		return append(appendMsgpackLen(b, len(v), 0xa0, 32, 0xd9), v...), nil
+	case []byte:
+		return append(appendMsgpackLen(b, len(v), 0, 0, 0xc4), v...), nil
+	case []interface{}:
+		b = appendMsgpackLen(b, len(v), 0x90, 16, 0xdc)
+		for _, e := range v {
+			var err error
+			if b, err = appendMsgpack(b, e); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[string]interface{}:
+		m := make(map[interface{}]interface{}, len(v))
+		for k, e := range v {
+			m[k] = e
+		}
+		return appendMsgpackMap(b, m)
+	case map[interface{}]interface{}:
+		return appendMsgpackMap(b, v)
+	}
+	return nil, fmt.Errorf("luabolt: can't encode %T as MessagePack", v)
+}
+
+func appendMsgpackMap(b []byte, m map[interface{}]interface{}) ([]byte, error) {
+	type entry struct{ k, v []byte }
+	entries := make([]entry, 0, len(m))
+	for k, v := range m {
+		var e entry
+		var err error
+		if e.k, err = appendMsgpack(nil, k); err != nil {
+			return nil, err
+		}
+		if e.v, err = appendMsgpack(nil, v); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].k, entries[j].k) < 0
+	})
+	b = appendMsgpackLen(b, len(entries), 0x80, 16, 0xde)
+	for _, e := range entries {
+		b = append(append(b, e.k...), e.v...)
+	}
+	return b, nil
+}
+
+// appendMsgpackLen appends the header of a value of length n. Lengths
+// below fixMax use the fix format fix, if any, and others the format
+// first, or the 2 formats after it for 16 and 32 bits lengths. The 16 bits
+// length of str, bin and ext formats follows an 8 bits one, unlike arrays
+// and maps.
+func appendMsgpackLen(b []byte, n int, fix byte, fixMax int, first byte) []byte {
+	switch {
+	case n < fixMax:
+		return append(b, fix|byte(n))
+	case first != 0xdc && first != 0xde && n <= math.MaxUint8:
+		return append(b, first, byte(n))
+	case first != 0xdc && first != 0xde:
+		first++
+	}
+	if n <= math.MaxUint16 {
+		return binary.BigEndian.AppendUint16(append(b, first), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(b, first+1), uint32(n))
+}
+
+func appendMsgpackNumber(b []byte, f float64) []byte {
+	switch {
+	case f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxUint64:
+		return binary.BigEndian.AppendUint64(append(b, 0xcb), math.Float64bits(f))
+	case f >= 0 && f < 128:
+		return append(b, byte(f))
+	case f >= -32 && f < 0:
+		return append(b, byte(int8(f)))
+	case f > 0 && f <= math.MaxUint8:
+		return append(b, 0xcc, byte(f))
+	case f > 0 && f <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xcd), uint16(f))
+	case f > 0 && f <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, 0xce), uint32(f))
+	case f > 0:
+		return binary.BigEndian.AppendUint64(append(b, 0xcf), uint64(f))
+	case f >= math.MinInt8:
+		return append(b, 0xd0, byte(int8(f)))
+	case f >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(b, 0xd1), uint16(int16(f)))
+	case f >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(b, 0xd2), uint32(int32(f)))
+	}
+	return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(int64(f)))
+}
+
+// msgpackDecoder decodes the MessagePack values of data, consuming it.
+type msgpackDecoder struct {
+	data []byte
+}
+
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.data) < n {
+		return nil, errMsgpackShort
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b, nil
+}
+
+// uint reads an unsigned integer of size bytes.
+func (d *msgpackDecoder) uint(size int) (uint64, error) {
+	b, err := d.next(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+func (d *msgpackDecoder) decode(depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("luabolt: can't decode a MessagePack value nested more than %d times", maxDepth)
+	}
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	switch c := b[0]; {
+	case c <= 0x7f:
+		return float64(c), nil
+	case c >= 0xe0:
+		return float64(int8(c)), nil
+	case c >= 0xa0 && c <= 0xbf:
+		return d.str(int(c & 0x1f))
+	case c >= 0x90 && c <= 0x9f:
+		return d.array(int(c&0x0f), depth)
+	case c >= 0x80 && c <= 0x8f:
+		return d.mapping(int(c&0x0f), depth)
+	case c == 0xc0:
+		return nil, nil
+	case c == 0xc2, c == 0xc3:
+		return c == 0xc3, nil
+	case c >= 0xc4 && c <= 0xc6:
+		n, err := d.uint(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		s, err := d.next(int(n))
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), s...), nil
+	case c == 0xca:
+		n, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(n))), err
+	case c == 0xcb:
+		n, err := d.uint(8)
+		return math.Float64frombits(n), err
+	case c >= 0xcc && c <= 0xcf:
+		n, err := d.uint(1 << (c - 0xcc))
+		return float64(n), err
+	case c >= 0xd0 && c <= 0xd3:
+		size := 1 << (c - 0xd0)
+		n, err := d.uint(size)
+		// Sign-extend the size bytes integer.
+		shift := uint(64 - 8*size)
+		return float64(int64(n<<shift) >> shift), err
+	case c >= 0xd9 && c <= 0xdb:
+		n, err := d.uint(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.str(int(n))
+	case c == 0xdc, c == 0xdd:
+		n, err := d.uint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.array(int(n), depth)
+	case c == 0xde, c == 0xdf:
+		n, err := d.uint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.mapping(int(n), depth)
+	default:
+		return nil, fmt.Errorf("luabolt: unsupported MessagePack format %#x", c)
+	}
+}
+
+func (d *msgpackDecoder) str(n int) (interface{}, error) {
+	s, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(s), nil
+}
+
+func (d *msgpackDecoder) array(n int, depth int) (interface{}, error) {
+	// Each element takes at least a byte.
+	if n > len(d.data) {
+		return nil, errMsgpackShort
+	}
+	s := make([]interface{}, n)
+	for i := range s {
+		var err error
+		if s[i], err = d.decode(depth + 1); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (d *msgpackDecoder) mapping(n int, depth int) (interface{}, error) {
+	if 2*n > len(d.data) {
+		return nil, errMsgpackShort
+	}
+	m := make(map[interface{}]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		switch k.(type) {
+		case nil, []byte, []interface{}, map[interface{}]interface{}:
+			return nil, fmt.Errorf("luabolt: unsupported MessagePack map key %T", k)
+		}
+		v, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		m[k] = v
+	}
+	return m, nil
+}
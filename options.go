@@ -8,7 +8,7 @@ import (
 )
 
 func init() {
-	registerMetaTable(TypeOptions, optionsFuncs)
+	registerMetaTable(TypeOptions, optionsFuncs, nil)
 }
 
 var optionsFuncs = []lua.RegistryFunction{
@@ -24,6 +24,8 @@ var optionsFuncs = []lua.RegistryFunction{
 				l.PushBoolean(options.ReadOnly)
 			case "mmap_flags":
 				l.PushInteger(options.MmapFlags)
+			case "initial_mmap_size":
+				l.PushInteger(options.InitialMmapSize)
 			default:
 				lua.Errorf(l, "bolt: unknown Options.%s", k)
 				panic("unreachable")
@@ -34,29 +36,83 @@ var optionsFuncs = []lua.RegistryFunction{
 	{
 		"__newindex", func(l *lua.State) int {
 			options := lua.CheckUserData(l, 1, TypeOptions).(*bolt.Options)
-			switch k := lua.CheckString(l, 2); k {
-			case "timeout":
-				d, err := time.ParseDuration(lua.CheckString(l, 3))
-				if err != nil {
-					lua.Errorf(l, err.Error())
-					panic("unreachable")
-				}
-				options.Timeout = d
-			case "no_grow_sync":
-				lua.CheckType(l, 3, lua.TypeBoolean)
-				v := l.ToBoolean(3)
-				options.NoGrowSync = v
-			case "read_only":
-				lua.CheckType(l, 3, lua.TypeBoolean)
-				v := l.ToBoolean(3)
-				options.ReadOnly = v
-			case "mmap_flags":
-				options.MmapFlags = lua.CheckInteger(l, 3)
-			default:
-				lua.Errorf(l, "bolt: unknown Options.%s", k)
-				panic("unreachable")
-			}
+			k := lua.CheckString(l, 2)
+			setOption(l, options, k, 3)
 			return 0
 		},
 	},
 }
+
+// newOptions returns options set from the fields of the table at index.
+func newOptions(l *lua.State, index int) *bolt.Options {
+	index = l.AbsIndex(index)
+	options := defaultOptions(l)
+	l.PushNil()
+	for l.Next(index) {
+		if l.TypeOf(-2) != lua.TypeString {
+			lua.Errorf(l, "bolt: bad Options key (string expected, got %s)", lua.TypeNameOf(l, -2))
+			panic("unreachable")
+		}
+		k, _ := l.ToString(-2)
+		setOption(l, options, k, -1)
+		l.Pop(1)
+	}
+	return options
+}
+
+// checkOptions returns the options at index, given either as an Options
+// userdata or as a table.
+func checkOptions(l *lua.State, index int) *bolt.Options {
+	if l.IsTable(index) {
+		return newOptions(l, index)
+	}
+	return lua.CheckUserData(l, index, TypeOptions).(*bolt.Options)
+}
+
+// setOption sets the option k to the value at index.
+func setOption(l *lua.State, options *bolt.Options, k string, index int) {
+	switch k {
+	case "timeout":
+		checkOptionType(l, k, index, lua.TypeString)
+		s, _ := l.ToString(index)
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			lua.Errorf(l, "bolt: bad Options.timeout (%s)", err.Error())
+			panic("unreachable")
+		}
+		options.Timeout = d
+	case "no_grow_sync":
+		checkOptionType(l, k, index, lua.TypeBoolean)
+		options.NoGrowSync = l.ToBoolean(index)
+	case "read_only":
+		checkOptionType(l, k, index, lua.TypeBoolean)
+		options.ReadOnly = l.ToBoolean(index)
+	case "mmap_flags":
+		checkOptionType(l, k, index, lua.TypeNumber)
+		options.MmapFlags, _ = l.ToInteger(index)
+	case "initial_mmap_size":
+		checkOptionType(l, k, index, lua.TypeNumber)
+		options.InitialMmapSize, _ = l.ToInteger(index)
+	default:
+		lua.Errorf(l, "bolt: unknown Options.%s", k)
+		panic("unreachable")
+	}
+}
+
+func checkOptionType(l *lua.State, k string, index int, t lua.Type) {
+	if l.TypeOf(index) != t {
+		lua.Errorf(l, "bolt: bad Options.%s (%s expected, got %s)", k, t.String(), lua.TypeNameOf(l, index))
+		panic("unreachable")
+	}
+}
+
+var boltOptions = func(l *lua.State) int {
+	options := defaultOptions(l)
+	if !l.IsNoneOrNil(1) {
+		lua.CheckType(l, 1, lua.TypeTable)
+		options = newOptions(l, 1)
+	}
+	l.PushUserData(options)
+	lua.SetMetaTableNamed(l, TypeOptions)
+	return 1
+}
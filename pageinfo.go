@@ -6,7 +6,7 @@ import (
 )
 
 func init() {
-	registerMetaTable(TypePageInfo, pageInfoFuncs)
+	registerMetaTable(TypePageInfo, pageInfoFuncs, nil)
 }
 
 var pageInfoFuncs = []lua.RegistryFunction{
@@ -0,0 +1,117 @@
+package luabolt
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/go-lua"
+)
+
+// Pool is a bounded pool of Lua states, so that concurrent goroutines
+// each run their scripts in a state of their own.
+//
+// A Lua state must not be used by two goroutines at once, but the states
+// of a pool can share the same databases: concurrent DB.batch calls from
+// them are grouped by bolt in the same transactions.
+type Pool struct {
+	newState func() (*lua.State, error)
+	idle     chan *lua.State
+	slots    chan struct{}
+
+	// accessed atomically
+	waits    int64
+	waitTime int64
+}
+
+// PoolStats are statistics on the use of a pool.
+type PoolStats struct {
+	Size  int // maximum number of states
+	Open  int // number of states created and not discarded
+	Idle  int // number of states waiting to be used
+	InUse int // number of states in use
+
+	Waits    int // number of Get calls which waited for a state
+	WaitTime time.Duration
+}
+
+// NewPool returns a pool of at most size states. The states are created
+// as needed with newState, which usually opens the bolt module and pushes
+// the databases.
+func NewPool(size int, newState func() (*lua.State, error)) *Pool {
+	if size <= 0 {
+		panic("pool size must be positive")
+	}
+	return &Pool{
+		newState: newState,
+		idle:     make(chan *lua.State, size),
+		slots:    make(chan struct{}, size),
+	}
+}
+
+// Get returns an idle state of the pool, or a new one. When all the states
+// are in use, it waits for one to be put back, until ctx is done.
+func (p *Pool) Get(ctx context.Context) (*lua.State, error) {
+	select {
+	case l := <-p.idle:
+		return l, nil
+	default:
+	}
+	select {
+	case p.slots <- struct{}{}:
+		return p.create()
+	default:
+	}
+	start := time.Now()
+	defer func() {
+		atomic.AddInt64(&p.waits, 1)
+		atomic.AddInt64(&p.waitTime, int64(time.Since(start)))
+	}()
+	select {
+	case l := <-p.idle:
+		return l, nil
+	case p.slots <- struct{}{}:
+		return p.create()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (p *Pool) create() (*lua.State, error) {
+	l, err := p.newState()
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	return l, nil
+}
+
+// Put puts back l in the pool, once the goroutine which got it is done
+// with it. The transactions and databases left open by its scripts are
+// released with CloseState, and the error it returns is returned.
+func (p *Pool) Put(l *lua.State) error {
+	err := CloseState(l)
+	p.idle <- l
+	return err
+}
+
+// Discard removes l from the pool, instead of putting it back, when it
+// is no longer usable.
+func (p *Pool) Discard(l *lua.State) error {
+	err := CloseState(l)
+	<-p.slots
+	return err
+}
+
+// Stats returns statistics on the use of the pool.
+func (p *Pool) Stats() PoolStats {
+	open, idle := len(p.slots), len(p.idle)
+	return PoolStats{
+		Size:     cap(p.slots),
+		Open:     open,
+		Idle:     idle,
+		InUse:    open - idle,
+		Waits:    int(atomic.LoadInt64(&p.waits)),
+		WaitTime: time.Duration(atomic.LoadInt64(&p.waitTime)),
+	}
+}
@@ -0,0 +1,260 @@
+package luabolt
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/boltdb/bolt"
+)
+
+// ErrUnknownDB is returned by bolt.open_named for a name which wasn't
+// registered with RegisterDB.
+var ErrUnknownDB = errors.New("unknown database")
+
+// dbs is the registry of the databases opened with bolt.open, and of those
+// registered by the host, so that opening the same file again reuses the
+// open DB instead of waiting for the lock of bolt.
+var dbs = struct {
+	sync.Mutex
+	byPath map[string]*sharedDB
+	byDB   map[*bolt.DB]*sharedDB
+	byName map[string]*sharedDB
+}{
+	byPath: make(map[string]*sharedDB),
+	byDB:   make(map[*bolt.DB]*sharedDB),
+	byName: make(map[string]*sharedDB),
+}
+
+// sharedDB is a database of the registry.
+type sharedDB struct {
+	path string
+	db   *bolt.DB
+	err  error
+	// ready is closed once the database is open, or failed to open.
+	ready chan struct{}
+	// mode and readOnly are the file mode and the ReadOnly option the
+	// database was opened with. The mode of the databases registered by
+	// the host is unknown: fromHost is set for them.
+	mode     os.FileMode
+	readOnly bool
+	fromHost bool
+	// refs is the number of references to the database.
+	refs int
+	// hosts is the number of registrations of the database by the host,
+	// which closes it.
+	hosts int
+	// dir is the directory of a temporary database, removed once it is
+	// closed.
+	dir string
+}
+
+// dbKey returns the key of the file at path in the registry.
+func dbKey(path string) (string, error) {
+	return filepath.Abs(path)
+}
+
+// acquireDB returns the database at path, opened with mode and options
+// if it isn't open yet, and takes a reference to it. It returns an error
+// wrapping bolt.ErrDatabaseOpen if the database is open with another mode
+// or ReadOnly option.
+func acquireDB(path string, mode os.FileMode, options *bolt.Options) (*bolt.DB, error) {
+	key, err := dbKey(path)
+	if err != nil {
+		return nil, err
+	}
+	readOnly := options != nil && options.ReadOnly
+	dbs.Lock()
+	s, ok := dbs.byPath[key]
+	if ok {
+		s.refs++
+		dbs.Unlock()
+		<-s.ready
+		if s.err != nil {
+			return nil, s.err
+		}
+		if s.readOnly != readOnly || !s.fromHost && s.mode != mode {
+			releaseDB(s.db)
+			return nil, fmt.Errorf("%w: %s with another mode or read_only option", bolt.ErrDatabaseOpen, key)
+		}
+		return s.db, nil
+	}
+	s = &sharedDB{path: key, mode: mode, readOnly: readOnly, refs: 1, ready: make(chan struct{})}
+	dbs.byPath[key] = s
+	dbs.Unlock()
+
+	s.db, s.err = bolt.Open(path, mode, options)
+	dbs.Lock()
+	if s.err != nil {
+		delete(dbs.byPath, key)
+	} else {
+		dbs.byDB[s.db] = s
+	}
+	dbs.Unlock()
+	close(s.ready)
+	return s.db, s.err
+}
+
+// acquireTempDB opens a database in a new temporary directory, which is
+// removed once the database is closed, and takes a reference to it.
+func acquireTempDB(options *bolt.Options) (*bolt.DB, error) {
+	dir, err := ioutil.TempDir("", "luabolt-")
+	if err != nil {
+		return nil, err
+	}
+	db, err := acquireDB(filepath.Join(dir, "bolt.db"), 0600, options)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	dbs.Lock()
+	dbs.byDB[db].dir = dir
+	dbs.Unlock()
+	return db, nil
+}
+
+// acquireNamedDB returns the database registered as name, and takes a
+// reference to it.
+func acquireNamedDB(name string) (*bolt.DB, error) {
+	dbs.Lock()
+	defer dbs.Unlock()
+	s, ok := dbs.byName[name]
+	if !ok {
+		return nil, ErrUnknownDB
+	}
+	s.refs++
+	return s.db, nil
+}
+
+// releaseDB releases a reference to db, taken by acquireDB, acquireTempDB or
+// acquireNamedDB. The database is closed with its last reference, and its
+// directory removed if it is temporary, unless it belongs to the host: it
+// is then only removed from the registry, once the host unregistered it.
+func releaseDB(db *bolt.DB) error {
+	dbs.Lock()
+	s, ok := dbs.byDB[db]
+	if !ok {
+		dbs.Unlock()
+		return nil
+	}
+	s.refs--
+	if s.refs > 0 || s.hosts > 0 {
+		dbs.Unlock()
+		return nil
+	}
+	delete(dbs.byDB, db)
+	if dbs.byPath[s.path] == s {
+		delete(dbs.byPath, s.path)
+	}
+	dbs.Unlock()
+	if s.fromHost {
+		return nil
+	}
+	err := db.Close()
+	if s.dir != "" {
+		if rerr := os.RemoveAll(s.dir); err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+// isSharedDB reports whether db is in the registry.
+func isSharedDB(db *bolt.DB) bool {
+	dbs.Lock()
+	defer dbs.Unlock()
+	_, ok := dbs.byDB[db]
+	return ok
+}
+
+// RegisterDB registers db as name, so that scripts can open it with
+// bolt.open_named(name), and so that bolt.open on its path returns it
+// instead of opening the file again.
+//
+// The database still belongs to the caller: scripts don't close it. It
+// returns an error if name is already registered, or if the file of db
+// was already opened from a script.
+func RegisterDB(name string, db *bolt.DB) error {
+	key, err := dbKey(db.Path())
+	if err != nil {
+		return err
+	}
+	dbs.Lock()
+	defer dbs.Unlock()
+	if _, ok := dbs.byName[name]; ok {
+		return errors.New("luabolt: database " + name + " already registered")
+	}
+	if s, ok := dbs.byPath[key]; ok && s.db != db {
+		return errors.New("luabolt: database " + key + " already open")
+	}
+	dbs.byName[name] = holdDB(db, key)
+	return nil
+}
+
+// UnregisterDB removes the database registered as name. The scripts which
+// opened it can still use it, until the caller closes it.
+func UnregisterDB(name string) {
+	dbs.Lock()
+	defer dbs.Unlock()
+	s, ok := dbs.byName[name]
+	if !ok {
+		return
+	}
+	delete(dbs.byName, name)
+	unholdDB(s)
+}
+
+// hostDB adds db to the registry as a database of the host, which scripts
+// don't close, until releaseHostDB is called.
+func hostDB(db *bolt.DB) {
+	key, err := dbKey(db.Path())
+	if err != nil {
+		key = db.Path()
+	}
+	dbs.Lock()
+	defer dbs.Unlock()
+	holdDB(db, key)
+}
+
+// releaseHostDB releases db, added to the registry by hostDB.
+func releaseHostDB(db *bolt.DB) {
+	dbs.Lock()
+	defer dbs.Unlock()
+	if s, ok := dbs.byDB[db]; ok {
+		unholdDB(s)
+	}
+}
+
+// holdDB adds a registration by the host of db, whose file is at key, and
+// returns its entry. Its file is only registered if no script opened it.
+// It must be called with dbs locked.
+func holdDB(db *bolt.DB, key string) *sharedDB {
+	s, ok := dbs.byDB[db]
+	if !ok {
+		s = &sharedDB{path: key, db: db, readOnly: db.IsReadOnly(), fromHost: true, ready: make(chan struct{})}
+		close(s.ready)
+		dbs.byDB[db] = s
+		if _, ok := dbs.byPath[key]; !ok {
+			dbs.byPath[key] = s
+		}
+	}
+	s.hosts++
+	return s
+}
+
+// unholdDB removes a registration by the host of the entry s, and removes
+// it from the registry with the last one, unless scripts opened it too. It
+// must be called with dbs locked.
+func unholdDB(s *sharedDB) {
+	s.hosts--
+	if s.hosts > 0 || s.refs > 0 {
+		return
+	}
+	if dbs.byPath[s.path] == s {
+		delete(dbs.byPath, s.path)
+	}
+	delete(dbs.byDB, s.db)
+}
@@ -0,0 +1,232 @@
+package luabolt
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Shopify/go-lua"
+)
+
+// openPath returns the path of the file bolt.open opens for path and mode,
+// once checked against the sandbox of the state: the Root, Modes and
+// MaxOpen fields of its Config.
+func openPath(l *lua.State, path string, mode os.FileMode) (string, error) {
+	if err := checkOpenCount(l); err != nil {
+		return "", err
+	}
+	return filePath(l, path, mode)
+}
+
+// filePath returns the path of the file a script opens or creates for path
+// and mode, once checked against the Root and Modes of the sandbox of the
+// state.
+func filePath(l *lua.State, path string, mode os.FileMode) (string, error) {
+	config := stateConfig(l)
+	if len(config.Modes) > 0 && !hasMode(config.Modes, mode) {
+		return "", fmt.Errorf("%w: file mode %#o", ErrPermission, mode)
+	}
+	if config.Root == "" {
+		return path, nil
+	}
+	return sandboxPath(config.Root, path)
+}
+
+// checkOpenCount returns an error if the state can't open another
+// database, as set by the MaxOpen field of its Config.
+func checkOpenCount(l *lua.State) error {
+	config := stateConfig(l)
+	if config.MaxOpen > 0 && len(stateResources(l).dbs) >= config.MaxOpen {
+		return fmt.Errorf("%w: more than %d open databases", ErrPermission, config.MaxOpen)
+	}
+	return nil
+}
+
+func hasMode(modes []os.FileMode, mode os.FileMode) bool {
+	for _, m := range modes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// sandboxPath returns the path of path relative to root, once its symbolic
+// links are resolved. It returns an error if path is absolute, has a ..
+// element, or resolves outside of root.
+func sandboxPath(root, path string) (string, error) {
+	if path == "" || filepath.IsAbs(path) || filepath.VolumeName(path) != "" {
+		return "", fmt.Errorf("%w: path %q isn't relative", ErrPermission, path)
+	}
+	for _, elem := range strings.Split(filepath.ToSlash(path), "/") {
+		if elem == ".." {
+			return "", fmt.Errorf("%w: path %q has a .. element", ErrPermission, path)
+		}
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	realRoot, err = filepath.Abs(realRoot)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := evalSymlinks(filepath.Join(realRoot, path))
+	if err != nil {
+		return "", err
+	}
+	if resolved != realRoot && !strings.HasPrefix(resolved, realRoot+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: path %q is outside of the root", ErrPermission, path)
+	}
+	return resolved, nil
+}
+
+// evalSymlinks is like filepath.EvalSymlinks, except that the trailing
+// elements of path may not exist yet. A dangling symbolic link is an
+// error, since opening it would create its target.
+func evalSymlinks(path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err == nil {
+		return resolved, nil
+	}
+	if fi, lerr := os.Lstat(path); lerr == nil && fi.Mode()&os.ModeSymlink != 0 {
+		return "", fmt.Errorf("%w: %q is a dangling symbolic link", ErrPermission, path)
+	} else if !os.IsNotExist(lerr) {
+		return "", err
+	}
+	dir, file := filepath.Split(path)
+	dir = filepath.Clean(dir)
+	if dir == path {
+		return "", err
+	}
+	resolvedDir, err := evalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(resolvedDir, file), nil
+}
+
+// IOMode is the access of the scripts of a sandboxed state to the files
+// under the root of its sandbox.
+type IOMode int
+
+const (
+	// IONone doesn't open the io library.
+	IONone IOMode = iota
+	// IORead opens an io library which only reads files.
+	IORead
+	// IOReadWrite opens an io library which reads and writes files.
+	IOReadWrite
+)
+
+// Profile configures the libraries of a state created by
+// NewSandboxedState.
+type Profile struct {
+	// Config configures the bolt module, which is also set as a global.
+	Config Config
+	// IO is the access to the files under Config.Root given by the io
+	// library. Only io.open and io.type are available, on paths relative
+	// to the root.
+	IO IOMode
+}
+
+// unsafeBaseFunctions are the functions of the base library not available
+// in a sandboxed state, since they access files or load code.
+var unsafeBaseFunctions = []string{"collectgarbage", "dofile", "load", "loadfile"}
+
+// sandboxLibraries are the standard libraries opened in a sandboxed state,
+// besides the base library.
+var sandboxLibraries = []lua.RegistryFunction{
+	{"string", lua.StringOpen},
+	{"table", lua.TableOpen},
+	{"math", lua.MathOpen},
+}
+
+// NewSandboxedState returns a Lua state for untrusted scripts, configured
+// by profile. It opens the base library, without the functions accessing
+// files or loading code, the string, table and math libraries, the bolt
+// module, and, if set by profile, an io library restricted to the root of
+// the sandbox. require only returns these modules.
+//
+// Without a root, the scripts can't access files: bolt.open and
+// Tx.copy_file are disabled, and it returns an error if profile opens the
+// io library.
+//
+// The state must not be opened again with other libraries: Open and
+// OpenWith panic on it, unless given the config of the sandbox.
+func NewSandboxedState(profile Profile) (*lua.State, error) {
+	if profile.IO != IONone && profile.Config.Root == "" {
+		return nil, errors.New("luabolt: the io library of a sandboxed state needs a root")
+	}
+	l := lua.NewState()
+	lua.Require(l, "_G", lua.BaseOpen, true)
+	l.Pop(1)
+	for _, name := range unsafeBaseFunctions {
+		l.PushNil()
+		l.SetGlobal(name)
+	}
+	l.Register("require", sandboxRequire)
+	for _, lib := range sandboxLibraries {
+		lua.Require(l, lib.Name, lib.Function, true)
+		l.Pop(1)
+	}
+	if profile.IO != IONone {
+		openSandboxIO(l, profile.Config.Root, profile.IO)
+	}
+	config := profile.Config
+	config.Global = true
+	if config.Root == "" {
+		config.Disabled |= CapOpen | CapCopyFile
+	}
+	OpenWith(l, config)
+	return l, nil
+}
+
+// sandboxRequire is the require function of a sandboxed state, which only
+// returns the modules already loaded.
+func sandboxRequire(l *lua.State) int {
+	name := lua.CheckString(l, 1)
+	l.Field(lua.RegistryIndex, "_LOADED")
+	l.Field(-1, name)
+	if l.IsNil(-1) {
+		lua.Errorf(l, "module '%s' not found", name)
+		panic("unreachable")
+	}
+	return 1
+}
+
+// openSandboxIO sets the io global of a sandboxed state to a library
+// opening the files under root, with the access of mode.
+func openSandboxIO(l *lua.State, root string, mode IOMode) {
+	lua.Require(l, "io", lua.IOOpen, false)
+	l.Field(-1, "open")
+	ioOpen := l.ToGoFunction(-1)
+	l.Field(-2, "type")
+	ioType := l.ToGoFunction(-1)
+	l.Pop(3)
+	lua.NewLibrary(l, []lua.RegistryFunction{
+		{"open", func(l *lua.State) int {
+			name := lua.CheckString(l, 1)
+			m := lua.OptString(l, 2, "r")
+			if mode == IORead && m != "r" {
+				return lua.FileResult(l, fmt.Errorf("%w: mode %q", ErrPermission, m), name)
+			}
+			path, err := sandboxPath(root, name)
+			if err != nil {
+				return lua.FileResult(l, err, name)
+			}
+			l.SetTop(0)
+			l.PushString(path)
+			l.PushString(m)
+			return ioOpen(l)
+		}},
+		{"type", ioType},
+	})
+	lua.SubTable(l, lua.RegistryIndex, "_LOADED")
+	l.PushValue(-2)
+	l.SetField(-2, "io")
+	l.Pop(1)
+	l.SetGlobal("io")
+}
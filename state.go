@@ -0,0 +1,162 @@
+package luabolt
+
+import (
+	"strings"
+
+	"github.com/Shopify/go-lua"
+	"github.com/boltdb/bolt"
+)
+
+// resourcesKey is the registry field holding the resources acquired by
+// the scripts of a Lua state.
+const resourcesKey = "github.com/vincent-petithory/luabolt.resources"
+
+// resources holds the transactions opened in a Lua state, including those
+// pushed by the host, and the databases opened with bolt.open, in the
+// order they were opened.
+type resources struct {
+	txs []*txState
+	dbs []*bolt.DB
+	// codecs are the codecs set on the buckets of each database by the
+	// committed transactions of the state, by bucketKey.
+	codecs map[*bolt.DB]map[string]string
+	// interrupt aborts the script, as set by SetContext.
+	interrupt *interrupt
+}
+
+func stateResources(l *lua.State) *resources {
+	l.Field(lua.RegistryIndex, resourcesKey)
+	r, ok := l.ToUserData(-1).(*resources)
+	l.Pop(1)
+	if !ok {
+		r = &resources{}
+		l.PushUserData(r)
+		l.SetField(lua.RegistryIndex, resourcesKey)
+	}
+	return r
+}
+
+// openTxs returns the transactions open in the state. Closed transactions
+// are forgotten.
+func (r *resources) openTxs() []*txState {
+	txs := r.txs[:0]
+	for _, s := range r.txs {
+		if !s.isClosed() {
+			txs = append(txs, s)
+		}
+	}
+	for i := len(txs); i < len(r.txs); i++ {
+		r.txs[i] = nil
+	}
+	r.txs = txs
+	return txs
+}
+
+// trackTx adds s to the transactions opened in the state.
+func trackTx(l *lua.State, s *txState) {
+	r := stateResources(l)
+	r.txs = append(r.txs, s)
+}
+
+// hostTx returns a handle for tx, pushed by the host. The values of a
+// transaction pushed by the host share its state, so that they are all
+// invalidated when the script closes it.
+func hostTx(l *lua.State, tx *bolt.Tx) *txHandle {
+	for _, s := range stateResources(l).openTxs() {
+		if s.tx == tx {
+			return &txHandle{s}
+		}
+	}
+	s := &txState{tx: tx}
+	trackTx(l, s)
+	return &txHandle{s}
+}
+
+// checkNested returns ErrTxNested if a transaction, writable or not,
+// can't be started on db in the state, because it could wait for the
+// transactions already open there: a write transaction waits for all of
+// them, and any transaction may wait for an open write transaction
+// remapping the database.
+func checkNested(l *lua.State, db *bolt.DB, writable bool) error {
+	for _, s := range stateResources(l).openTxs() {
+		if s.tx.DB() == db && (writable || s.tx.Writable()) {
+			return ErrTxNested
+		}
+	}
+	return nil
+}
+
+// trackDB adds db to the databases opened with bolt.open in the state.
+func trackDB(l *lua.State, db *bolt.DB) {
+	r := stateResources(l)
+	r.dbs = append(r.dbs, db)
+}
+
+// untrackDB removes db from the databases opened in the state, once the
+// script closed it. It reports whether the state had opened db.
+func untrackDB(l *lua.State, db *bolt.DB) bool {
+	r := stateResources(l)
+	for i, d := range r.dbs {
+		if d == db {
+			r.dbs = append(r.dbs[:i], r.dbs[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// where returns the location of the script calling the current function.
+func where(l *lua.State) string {
+	lua.Where(l, 1)
+	s, _ := l.ToString(-1)
+	l.Pop(1)
+	return strings.TrimSuffix(s, ": ")
+}
+
+// LeakError is returned by CloseState when the scripts of a Lua state left
+// transactions or databases open.
+type LeakError struct {
+	// Txs are the locations where the leaked transactions were begun.
+	Txs []string
+	// DBs are the paths of the leaked databases.
+	DBs []string
+}
+
+func (e *LeakError) Error() string {
+	var leaks []string
+	for _, w := range e.Txs {
+		leaks = append(leaks, "tx begun at "+w)
+	}
+	for _, path := range e.DBs {
+		leaks = append(leaks, "db "+path)
+	}
+	return "luabolt: leaked " + strings.Join(leaks, ", ")
+}
+
+// CloseState releases what the scripts run in l left open: it rolls back
+// the transactions begun with DB.begin, then releases the databases opened
+// with bolt.open, closing those no other state uses, and the temporary ones
+// of bolt.open_temp. It returns a *LeakError listing them, if any.
+//
+// The transactions and databases pushed by the host are left to it.
+// CloseState must not be called while a script runs in l.
+func CloseState(l *lua.State) error {
+	r := stateResources(l)
+	var e LeakError
+	for _, s := range r.openTxs() {
+		if s.rollbackLeaked() {
+			e.Txs = append(e.Txs, s.where)
+		}
+	}
+	r.txs = nil
+	for _, db := range r.dbs {
+		e.DBs = append(e.DBs, db.Path())
+		delete(r.codecs, db)
+		releaseDB(db)
+	}
+	r.dbs = nil
+	if len(e.Txs) == 0 && len(e.DBs) == 0 {
+		return nil
+	}
+	return &e
+}
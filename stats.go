@@ -6,7 +6,7 @@ import (
 )
 
 func init() {
-	registerMetaTable(TypeStats, statsFuncs)
+	registerMetaTable(TypeStats, statsFuncs, statsMethods)
 }
 
 var statsFuncs = []lua.RegistryFunction{
@@ -29,14 +29,6 @@ var statsFuncs = []lua.RegistryFunction{
 			case "tx_stats":
 				l.PushUserData(&stats.TxStats)
 				lua.SetMetaTableNamed(l, TypeTxStats)
-			case "sub":
-				l.PushGoFunction(func(l *lua.State) int {
-					other := lua.CheckUserData(l, 1, TypeStats).(*bolt.Stats)
-					sub := stats.Sub(other)
-					l.PushUserData(&sub)
-					lua.SetMetaTableNamed(l, TypeStats)
-					return 1
-				})
 			default:
 				lua.Errorf(l, "bolt: unknown Stats.%s", k)
 				panic("unreachable")
@@ -61,7 +53,7 @@ var statsFuncs = []lua.RegistryFunction{
 			case "open_tx_n":
 				stats.OpenTxN = lua.CheckInteger(l, 3)
 			case "tx_stats":
-				txStats := lua.CheckUserData(l, 1, TypeDB).(*bolt.TxStats)
+				txStats := checkTxStats(l, 3)
 				stats.TxStats = *txStats
 			default:
 				lua.Errorf(l, "bolt: unknown Stats.%s", k)
@@ -71,3 +63,20 @@ var statsFuncs = []lua.RegistryFunction{
 		},
 	},
 }
+
+var statsMethods = []lua.RegistryFunction{
+	{
+		"sub", func(l *lua.State) int {
+			stats := checkStats(l, 1)
+			other := checkStats(l, 2)
+			sub := stats.Sub(other)
+			l.PushUserData(&sub)
+			lua.SetMetaTableNamed(l, TypeStats)
+			return 1
+		},
+	},
+}
+
+func checkStats(l *lua.State, index int) *bolt.Stats {
+	return lua.CheckUserData(l, index, TypeStats).(*bolt.Stats)
+}
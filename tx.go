@@ -1,173 +1,27 @@
 package luabolt
 
 import (
+	"errors"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+
 	"github.com/Shopify/go-lua"
 	"github.com/boltdb/bolt"
 )
 
 func init() {
-	registerMetaTable(TypeTx, txFuncs)
+	registerMetaTable(TypeTx, txFuncs, txMethods)
 }
 
 var txFuncs = []lua.RegistryFunction{
 	{
 		"__index", func(l *lua.State) int {
-			tx := lua.CheckUserData(l, 1, TypeTx).(*bolt.Tx)
+			tx, _ := checkTx(l, 1)
 			switch k := lua.CheckString(l, 2); k {
 			case "write_flag":
 				l.PushInteger(tx.WriteFlag)
-			case "bucket":
-				l.PushGoFunction(func(l *lua.State) int {
-					name := checkBytes(l, 1)
-					b := tx.Bucket(name)
-					if b == nil {
-						l.PushNil()
-					} else {
-						l.PushUserData(b)
-						lua.SetMetaTableNamed(l, TypeBucket)
-					}
-					return 1
-				})
-			case "check":
-				l.PushGoFunction(func(l *lua.State) int {
-					err := <-tx.Check()
-					if err != nil {
-						lua.Errorf(l, err.Error())
-						panic("unreachable")
-					}
-					return 0
-				})
-			case "commit":
-				l.PushGoFunction(func(l *lua.State) int {
-					if err := tx.Commit(); err != nil {
-						lua.Errorf(l, err.Error())
-						panic("unreachable")
-					}
-					return 0
-				})
-			case "copy", "write_to":
-				// TODO impl
-				panic("not implemented")
-			case "copy_file":
-				// TODO impl
-				panic("not implemented")
-			case "create_bucket":
-				l.PushGoFunction(func(l *lua.State) int {
-					name := checkBytes(l, 1)
-					b, err := tx.CreateBucket(name)
-					if err != nil {
-						lua.Errorf(l, err.Error())
-						panic("unreachable")
-					}
-					l.PushUserData(b)
-					lua.SetMetaTableNamed(l, TypeBucket)
-					return 1
-				})
-			case "create_bucket_if_not_exists":
-				l.PushGoFunction(func(l *lua.State) int {
-					name := checkBytes(l, 1)
-					b, err := tx.CreateBucketIfNotExists(name)
-					if err != nil {
-						lua.Errorf(l, err.Error())
-						panic("unreachable")
-					}
-					l.PushUserData(b)
-					lua.SetMetaTableNamed(l, TypeBucket)
-					return 1
-				})
-			case "cursor":
-				l.PushGoFunction(func(l *lua.State) int {
-					c := tx.Cursor()
-					l.PushUserData(c)
-					lua.SetMetaTableNamed(l, TypeCursor)
-					return 1
-				})
-			case "db":
-				l.PushGoFunction(func(l *lua.State) int {
-					db := tx.DB()
-					l.PushUserData(db)
-					lua.SetMetaTableNamed(l, TypeDB)
-					return 1
-				})
-			case "delete_bucket":
-				l.PushGoFunction(func(l *lua.State) int {
-					name := checkBytes(l, 1)
-					if err := tx.DeleteBucket(name); err != nil {
-						lua.Errorf(l, err.Error())
-						panic("unreachable")
-					}
-					return 0
-				})
-			case "for_each":
-				l.PushGoFunction(func(l *lua.State) int {
-					lua.CheckType(l, 1, lua.TypeFunction)
-					err := tx.ForEach(func(name []byte, b *bolt.Bucket) error {
-						l.PushValue(1)
-						pushBytes(l, name)
-						l.PushUserData(b)
-						lua.SetMetaTableNamed(l, TypeBucket)
-						l.Call(2, 0)
-						return nil
-					})
-					if err != nil {
-						lua.Errorf(l, err.Error())
-						panic("unreachable")
-					}
-					return 0
-				})
-			case "id":
-				l.PushGoFunction(func(l *lua.State) int {
-					id := tx.ID()
-					l.PushInteger(id)
-					return 1
-				})
-			case "on_commit":
-				l.PushGoFunction(func(l *lua.State) int {
-					tx.OnCommit(func() {
-						lua.CheckType(l, 1, lua.TypeFunction)
-						l.Call(0, 0)
-					})
-					return 0
-				})
-			case "page_info":
-				l.PushGoFunction(func(l *lua.State) int {
-					id := lua.CheckInteger(l, 1)
-					pi, err := tx.Page(id)
-					if err != nil {
-						lua.Errorf(l, err.Error())
-						panic("unreachable")
-					}
-					l.PushUserData(pi)
-					lua.SetMetaTableNamed(l, TypePageInfo)
-					return 1
-				})
-			case "rollback":
-				l.PushGoFunction(func(l *lua.State) int {
-					if err := tx.Rollback(); err != nil {
-						lua.Errorf(l, err.Error())
-						panic("unreachable")
-					}
-					return 0
-				})
-			case "size":
-				l.PushGoFunction(func(l *lua.State) int {
-					i := tx.Size()
-					l.PushInteger(int(i))
-					return 1
-				})
-			case "stats":
-				l.PushGoFunction(func(l *lua.State) int {
-					stats := tx.Stats()
-					l.PushUserData(&stats)
-					lua.SetMetaTableNamed(l, TypeTxStats)
-					return 1
-				})
-			case "writable":
-				l.PushGoFunction(func(l *lua.State) int {
-					b := tx.Writable()
-					l.PushBoolean(b)
-					return 1
-				})
 			default:
 				lua.Errorf(l, "bolt: unknown Tx.%s", k)
 				panic("unreachable")
@@ -175,9 +29,34 @@ var txFuncs = []lua.RegistryFunction{
 			return 1
 		},
 	},
+	{
+		"__pairs", func(l *lua.State) int {
+			tx, h := checkTx(l, 1)
+			c := tx.Cursor()
+			started := false
+			l.PushGoFunction(func(l *lua.State) int {
+				h.check(l, "Tx")
+				var name []byte
+				if started {
+					name, _ = c.Next()
+				} else {
+					name, _ = c.First()
+					started = true
+				}
+				if name == nil {
+					l.PushNil()
+					return 1
+				}
+				pushBytes(l, name)
+				pushBucket(l, tx.Bucket(name), h, []string{string(name)})
+				return 2
+			})
+			return 1
+		},
+	},
 	{
 		"__newindex", func(l *lua.State) int {
-			tx := lua.CheckUserData(l, 1, TypeTx).(*bolt.Tx)
+			tx, _ := checkTx(l, 1)
 			switch k := lua.CheckString(l, 2); k {
 			case "write_flag":
 				tx.WriteFlag = lua.CheckInteger(l, 3)
@@ -189,3 +68,388 @@ var txFuncs = []lua.RegistryFunction{
 		},
 	},
 }
+
+var txMethods = []lua.RegistryFunction{
+	{
+		"bucket", func(l *lua.State) int {
+			tx, h := checkTx(l, 1)
+			name := checkBytes(l, 2)
+			b := tx.Bucket(name)
+			if b == nil {
+				l.PushNil()
+			} else {
+				pushBucket(l, b, h, []string{string(name)})
+			}
+			return 1
+		},
+	},
+	{
+		"check", func(l *lua.State) int {
+			tx, _ := checkTx(l, 1)
+			if !allowed(l, CapCheck) {
+				return fail(l, "Tx.check", ErrPermission)
+			}
+			err := <-tx.Check()
+			if err != nil {
+				return fail(l, "Tx.check", err)
+			}
+			l.PushBoolean(true)
+			return 1
+		},
+	},
+	{
+		"commit", func(l *lua.State) int {
+			tx, h := checkTx(l, 1)
+			if h.managed {
+				raise(l, "Tx.commit", errTxManaged)
+			}
+			if err := h.end(tx.Commit); err != nil {
+				return fail(l, "Tx.commit", err)
+			}
+			l.PushBoolean(true)
+			return 1
+		},
+	},
+	{
+		"copy", func(l *lua.State) int {
+			tx, _ := checkTx(l, 1)
+			if err := tx.Copy(checkWriter(l, 2)); err != nil {
+				return fail(l, "Tx.copy", err)
+			}
+			l.PushBoolean(true)
+			return 1
+		},
+	},
+	{
+		"copy_file", func(l *lua.State) int {
+			tx, h := checkTx(l, 1)
+			path := lua.CheckString(l, 2)
+			mode := lua.CheckUnsigned(l, 3)
+			if h.readOnly || !allowed(l, CapCopyFile) {
+				return fail(l, "Tx.copy_file", ErrPermission)
+			}
+			path, err := filePath(l, path, os.FileMode(mode))
+			if err != nil {
+				return fail(l, "Tx.copy_file", err)
+			}
+			if err := tx.CopyFile(path, os.FileMode(mode)); err != nil {
+				return fail(l, "Tx.copy_file", err)
+			}
+			l.PushBoolean(true)
+			return 1
+		},
+	},
+	{
+		"create_bucket", func(l *lua.State) int {
+			tx, h := checkTx(l, 1)
+			name := checkBytes(l, 2)
+			b, err := tx.CreateBucket(name)
+			if err != nil {
+				return fail(l, "Tx.create_bucket", err)
+			}
+			pushBucket(l, b, h, []string{string(name)})
+			return 1
+		},
+	},
+	{
+		"create_bucket_if_not_exists", func(l *lua.State) int {
+			tx, h := checkTx(l, 1)
+			name := checkBytes(l, 2)
+			b, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return fail(l, "Tx.create_bucket_if_not_exists", err)
+			}
+			pushBucket(l, b, h, []string{string(name)})
+			return 1
+		},
+	},
+	{
+		"cursor", func(l *lua.State) int {
+			tx, h := checkTx(l, 1)
+			pushCursor(l, tx.Cursor(), h, []string{})
+			return 1
+		},
+	},
+	{
+		"db", func(l *lua.State) int {
+			tx, h := checkTx(l, 1)
+			pushDB(l, tx.DB(), h.readOnly)
+			return 1
+		},
+	},
+	{
+		"delete_bucket", func(l *lua.State) int {
+			tx, h := checkTx(l, 1)
+			name := checkBytes(l, 2)
+			if err := tx.DeleteBucket(name); err != nil {
+				return fail(l, "Tx.delete_bucket", err)
+			}
+			h.deleteBucketCodecs(l, []string{string(name)})
+			l.PushBoolean(true)
+			return 1
+		},
+	},
+	{
+		"for_each", func(l *lua.State) int {
+			tx, h := checkTx(l, 1)
+			lua.CheckType(l, 2, lua.TypeFunction)
+			f := newIterCallback(l, "Tx.for_each", 2)
+			return f.result(tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+				pushBytes(l, name)
+				pushBucket(l, b, h, []string{string(name)})
+				return f.call(2)
+			}))
+		},
+	},
+	{
+		"id", func(l *lua.State) int {
+			tx, _ := checkTx(l, 1)
+			id := tx.ID()
+			l.PushInteger(id)
+			return 1
+		},
+	},
+	{
+		"on_commit", func(l *lua.State) int {
+			tx, _ := checkTx(l, 1)
+			lua.CheckType(l, 2, lua.TypeFunction)
+			r := ref(l, 2)
+			tx.OnCommit(func() {
+				pushRef(l, r)
+				unref(l, r)
+				l.Call(0, 0)
+			})
+			return 0
+		},
+	},
+	{
+		"page_info", func(l *lua.State) int {
+			tx, _ := checkTx(l, 1)
+			id := lua.CheckInteger(l, 2)
+			if !allowed(l, CapPageInfo) {
+				return fail(l, "Tx.page_info", ErrPermission)
+			}
+			pi, err := tx.Page(id)
+			if err != nil {
+				return fail(l, "Tx.page_info", err)
+			}
+			l.PushUserData(pi)
+			lua.SetMetaTableNamed(l, TypePageInfo)
+			return 1
+		},
+	},
+	{
+		"rollback", func(l *lua.State) int {
+			tx, h := checkTx(l, 1)
+			if h.managed {
+				raise(l, "Tx.rollback", errTxManaged)
+			}
+			if err := h.end(tx.Rollback); err != nil {
+				return fail(l, "Tx.rollback", err)
+			}
+			l.PushBoolean(true)
+			return 1
+		},
+	},
+	{
+		"size", func(l *lua.State) int {
+			tx, _ := checkTx(l, 1)
+			i := tx.Size()
+			l.PushInteger(int(i))
+			return 1
+		},
+	},
+	{
+		"stats", func(l *lua.State) int {
+			tx, _ := checkTx(l, 1)
+			stats := tx.Stats()
+			l.PushUserData(&stats)
+			lua.SetMetaTableNamed(l, TypeTxStats)
+			return 1
+		},
+	},
+	{
+		"writable", func(l *lua.State) int {
+			tx, _ := checkTx(l, 1)
+			b := tx.Writable()
+			l.PushBoolean(b)
+			return 1
+		},
+	},
+	{
+		"write_to", func(l *lua.State) int {
+			tx, _ := checkTx(l, 1)
+			n, err := tx.WriteTo(checkWriter(l, 2))
+			if err != nil {
+				return fail(l, "Tx.write_to", err)
+			}
+			l.PushInteger(int(n))
+			return 1
+		},
+	},
+}
+
+// txHandle is the value of a Tx userdata. It tracks the lifetime of the
+// transaction for the values obtained from it, so that they aren't used
+// once it is closed.
+//
+// A managed transaction, run by DB.update, DB.view or DB.batch, is closed
+// by bolt and can't be committed or rolled back by the script.
+type txHandle struct {
+	*txState
+}
+
+// txState is the state of a transaction, shared by its handle and the
+// resources of the Lua state. Unlike the handle, it doesn't keep the
+// values of the script alive, so that a transaction begun by the script
+// and no longer reachable is rolled back by the finalizer of its handle.
+type txState struct {
+	tx      *bolt.Tx
+	managed bool
+	// begun is set for transactions begun by the script with DB.begin,
+	// which it must close.
+	begun bool
+	// where is the location in the script that begun the transaction.
+	where string
+	// readOnly is set for transactions started from a read-only DB, whose
+	// Tx.db method returns the read-only DB.
+	readOnly bool
+
+	// codecOps are the changes of the codecs of the buckets, set with
+	// their codec field, kept by the state once the transaction is
+	// committed.
+	codecOps []codecOp
+
+	mu     sync.Mutex
+	closed bool
+}
+
+var errTxManaged = errors.New("managed tx commit or rollback not allowed")
+
+// ErrTxNested is returned when a script starts a write transaction while
+// another transaction is open on the same database in its Lua state, or
+// any transaction while a write transaction is open there, which could
+// block forever on the locks of bolt.
+var ErrTxNested = errors.New("transaction nested in an open write transaction")
+
+// beginTx returns the handle of tx, begun by the script with DB.begin. The
+// transaction is rolled back once the handle is garbage collected, if the
+// script didn't close it: go-lua doesn't call __gc metamethods, so a Go
+// finalizer does it.
+func beginTx(l *lua.State, tx *bolt.Tx, readOnly bool) *txHandle {
+	h := &txHandle{&txState{tx: tx, begun: true, where: where(l), readOnly: readOnly}}
+	trackTx(l, h.txState)
+	runtime.SetFinalizer(h, func(h *txHandle) { h.rollbackLeaked() })
+	return h
+}
+
+// isClosed reports whether the transaction is closed, by the script, or by
+// the host for a transaction it pushed.
+func (s *txState) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed || s.tx.DB() == nil
+}
+
+// close marks the transaction as closed, and reports whether it was open.
+func (s *txState) close() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.closed = true
+	return true
+}
+
+// end ends the transaction with end, its Commit or Rollback method, and
+// marks it as closed if bolt closed it: a read-only transaction stays open
+// when its commit fails.
+func (s *txState) end(end func() error) error {
+	err := end()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tx.DB() == nil {
+		s.closed = true
+	}
+	return err
+}
+
+// rollbackLeaked rolls back the transaction if it was begun by the script
+// and is still open, and reports whether it did. It is called by the
+// finalizer goroutine too, so the transaction is rolled back under the
+// lock checked by isClosed.
+func (s *txState) rollbackLeaked() bool {
+	if !s.begun {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.tx.DB() == nil {
+		return false
+	}
+	s.closed = true
+	s.tx.Rollback()
+	return true
+}
+
+func pushTx(l *lua.State, h *txHandle) {
+	l.PushUserData(h)
+	lua.SetMetaTableNamed(l, TypeTx)
+}
+
+// check raises an ERR_TX_CLOSED error, reported by op, if the transaction
+// is closed.
+func (h *txHandle) check(l *lua.State, op string) {
+	if h.isClosed() {
+		raise(l, op, bolt.ErrTxClosed)
+	}
+}
+
+// checkTx returns the transaction at index, and its handle. It raises an
+// error if the transaction is closed.
+func checkTx(l *lua.State, index int) (*bolt.Tx, *txHandle) {
+	h := lua.CheckUserData(l, index, TypeTx).(*txHandle)
+	h.check(l, "Tx")
+	return h.tx, h
+}
+
+// checkWriter returns a writer for the value at index: either a userdata
+// holding an io.Writer, or any value with a write method, like a file
+// handle of the io library.
+func checkWriter(l *lua.State, index int) io.Writer {
+	index = l.AbsIndex(index)
+	if w, ok := l.ToUserData(index).(io.Writer); ok {
+		return w
+	}
+	hasWrite := false
+	if t := l.TypeOf(index); t == lua.TypeTable || t == lua.TypeUserData {
+		l.Field(index, "write")
+		hasWrite = l.IsFunction(-1)
+		l.Pop(1)
+	}
+	lua.ArgumentCheck(l, hasWrite, index, "writer expected")
+	return &luaWriter{l: l, index: index}
+}
+
+// luaWriter writes to a Lua value by calling its write method.
+type luaWriter struct {
+	l     *lua.State
+	index int
+}
+
+func (w *luaWriter) Write(p []byte) (int, error) {
+	l := w.l
+	top := l.Top()
+	defer l.SetTop(top)
+	l.Field(w.index, "write")
+	l.PushValue(w.index)
+	l.PushString(string(p))
+	if err := l.ProtectedCall(2, 2, 0); err != nil {
+		return 0, err
+	}
+	if !l.ToBoolean(-2) && !l.IsNil(-1) {
+		return 0, toError(l, -1)
+	}
+	return len(p), nil
+}
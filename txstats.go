@@ -8,7 +8,7 @@ import (
 )
 
 func init() {
-	registerMetaTable(TypeTxStats, txStatsFuncs)
+	registerMetaTable(TypeTxStats, txStatsFuncs, txStatsMethods)
 }
 
 var txStatsFuncs = []lua.RegistryFunction{
@@ -40,14 +40,6 @@ var txStatsFuncs = []lua.RegistryFunction{
 				l.PushInteger(txStats.Write)
 			case "write_time":
 				l.PushString(txStats.WriteTime.String())
-			case "sub":
-				l.PushGoFunction(func(l *lua.State) int {
-					other := lua.CheckUserData(l, 1, TypeTxStats).(*bolt.TxStats)
-					sub := txStats.Sub(other)
-					l.PushUserData(&sub)
-					lua.SetMetaTableNamed(l, TypeTxStats)
-					return 1
-				})
 			default:
 				lua.Errorf(l, "bolt: unknown TxStats.%s", k)
 				panic("unreachable")
@@ -106,3 +98,20 @@ var txStatsFuncs = []lua.RegistryFunction{
 		},
 	},
 }
+
+var txStatsMethods = []lua.RegistryFunction{
+	{
+		"sub", func(l *lua.State) int {
+			txStats := checkTxStats(l, 1)
+			other := checkTxStats(l, 2)
+			sub := txStats.Sub(other)
+			l.PushUserData(&sub)
+			lua.SetMetaTableNamed(l, TypeTxStats)
+			return 1
+		},
+	},
+}
+
+func checkTxStats(l *lua.State, index int) *bolt.TxStats {
+	return lua.CheckUserData(l, index, TypeTxStats).(*bolt.TxStats)
+}
@@ -0,0 +1,228 @@
+package luabolt
+
+import (
+	"fmt"
+	"reflect"
+	"unicode/utf8"
+
+	"github.com/Shopify/go-lua"
+	"github.com/boltdb/bolt"
+)
+
+// maxDepth is the maximum nesting of the tables converted between Go and
+// Lua values, which also stops on cyclic values.
+const maxDepth = 100
+
+// TableMode is how Lua tables are converted to Go values.
+type TableMode int
+
+const (
+	// TablesAuto converts sequences to []interface{}, tables with only
+	// string keys, and empty tables, to map[string]interface{}, and other
+	// tables to map[interface{}]interface{}.
+	TablesAuto TableMode = iota
+	// TablesMap converts all tables to map[interface{}]interface{}.
+	TablesMap
+)
+
+// StringMode is how Lua strings are converted to Go values.
+type StringMode int
+
+const (
+	// StringsAuto converts valid UTF-8 strings to string, and other
+	// strings to []byte.
+	StringsAuto StringMode = iota
+	// StringsString converts all strings to string.
+	StringsString
+	// StringsBytes converts all strings to []byte, except table keys.
+	StringsBytes
+)
+
+// Conversion configures the conversion of Lua values to Go values.
+//
+// Lua nil, booleans and numbers are converted to nil, bool and float64.
+// Strings and tables are converted as set by Strings and Tables. Other
+// values can't be converted.
+type Conversion struct {
+	Tables  TableMode
+	Strings StringMode
+}
+
+// DefaultConversion is the Conversion used by Exec, ExecTx and Engine.
+var DefaultConversion = Conversion{}
+
+// pushValue pushes the Lua value of the Go value v.
+//
+// Booleans, numbers and strings are pushed as such, as well as []byte.
+// Slices and arrays are pushed as sequences, and maps as tables. Nil,
+// including nil pointers, is pushed as nil, and a *bolt.DB as a DB.
+func pushValue(l *lua.State, v interface{}) error {
+	return pushReflectValue(l, reflect.ValueOf(v), 0)
+}
+
+func pushReflectValue(l *lua.State, v reflect.Value, depth int) error {
+	if depth > maxDepth {
+		return fmt.Errorf("luabolt: can't convert a Go value nested more than %d times", maxDepth)
+	}
+	if !v.IsValid() {
+		l.PushNil()
+		return nil
+	}
+	if !v.CanInterface() {
+		return fmt.Errorf("luabolt: can't convert an unexported %s to a Lua value", v.Type())
+	}
+	if db, ok := v.Interface().(*bolt.DB); ok && db != nil {
+		PushDBValue(l, db)
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		l.PushBoolean(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		l.PushNumber(float64(v.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		l.PushNumber(float64(v.Uint()))
+	case reflect.Float32, reflect.Float64:
+		l.PushNumber(v.Float())
+	case reflect.String:
+		l.PushString(v.String())
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			l.PushNil()
+			return nil
+		}
+		return pushReflectValue(l, v.Elem(), depth+1)
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			l.PushNil()
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			l.PushString(string(b))
+			return nil
+		}
+		l.CheckStack(2)
+		l.CreateTable(v.Len(), 0)
+		for i := 0; i < v.Len(); i++ {
+			if err := pushReflectValue(l, v.Index(i), depth+1); err != nil {
+				l.Pop(1)
+				return err
+			}
+			l.RawSetInt(-2, i+1)
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			l.PushNil()
+			return nil
+		}
+		l.CheckStack(3)
+		l.CreateTable(0, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			if err := pushReflectValue(l, iter.Key(), depth+1); err != nil {
+				l.Pop(1)
+				return err
+			}
+			if l.IsNil(-1) {
+				l.Pop(2)
+				return fmt.Errorf("luabolt: can't convert a nil map key to a Lua value")
+			}
+			if err := pushReflectValue(l, iter.Value(), depth+1); err != nil {
+				l.Pop(2)
+				return err
+			}
+			l.RawSet(-3)
+		}
+	default:
+		return fmt.Errorf("luabolt: can't convert %s to a Lua value", v.Type())
+	}
+	return nil
+}
+
+// toValue returns the Go value of the Lua value at index.
+func (c Conversion) toValue(l *lua.State, index int) (interface{}, error) {
+	return c.toValueDepth(l, l.AbsIndex(index), 0)
+}
+
+func (c Conversion) toValueDepth(l *lua.State, index int, depth int) (interface{}, error) {
+	switch t := l.TypeOf(index); t {
+	case lua.TypeNil, lua.TypeNone:
+		return nil, nil
+	case lua.TypeBoolean:
+		return l.ToBoolean(index), nil
+	case lua.TypeNumber:
+		n, _ := l.ToNumber(index)
+		return n, nil
+	case lua.TypeString:
+		s, _ := l.ToString(index)
+		switch {
+		case c.Strings == StringsBytes,
+			c.Strings == StringsAuto && !utf8.ValidString(s):
+			return []byte(s), nil
+		}
+		return s, nil
+	case lua.TypeTable:
+		if depth >= maxDepth {
+			return nil, fmt.Errorf("luabolt: can't convert a Lua table nested more than %d times", maxDepth)
+		}
+		return c.toTable(l, index, depth)
+	default:
+		return nil, fmt.Errorf("luabolt: can't convert a Lua %s to a Go value", t)
+	}
+}
+
+// toTable returns the Go value of the table at index.
+func (c Conversion) toTable(l *lua.State, index int, depth int) (interface{}, error) {
+	type entry struct{ k, v interface{} }
+	var entries []entry
+	n := l.RawLength(index)
+	seq, strKeys := true, true
+	l.CheckStack(3)
+	l.PushNil()
+	for l.Next(index) {
+		var k interface{}
+		switch l.TypeOf(-2) {
+		case lua.TypeString:
+			k, _ = l.ToString(-2)
+			seq = false
+		case lua.TypeNumber, lua.TypeBoolean:
+			k, _ = c.toValueDepth(l, -2, depth+1)
+			if f, ok := k.(float64); !ok || f != float64(int(f)) || f < 1 || int(f) > n {
+				seq = false
+			}
+			strKeys = false
+		default:
+			t := l.TypeOf(-2)
+			l.Pop(2)
+			return nil, fmt.Errorf("luabolt: can't convert a Lua %s table key to a Go value", t)
+		}
+		v, err := c.toValueDepth(l, l.AbsIndex(-1), depth+1)
+		if err != nil {
+			l.Pop(2)
+			return nil, err
+		}
+		entries = append(entries, entry{k, v})
+		l.Pop(1)
+	}
+	switch {
+	case c.Tables == TablesAuto && len(entries) > 0 && seq && len(entries) == n:
+		s := make([]interface{}, n)
+		for _, e := range entries {
+			s[int(e.k.(float64))-1] = e.v
+		}
+		return s, nil
+	case c.Tables == TablesAuto && strKeys:
+		m := make(map[string]interface{}, len(entries))
+		for _, e := range entries {
+			m[e.k.(string)] = e.v
+		}
+		return m, nil
+	}
+	m := make(map[interface{}]interface{}, len(entries))
+	for _, e := range entries {
+		m[e.k] = e.v
+	}
+	return m, nil
+}